@@ -0,0 +1,103 @@
+// Command ssms-webhook is a stand-in webhook receiver, it prints the
+// membership events SSMS posts to it, one JSON line per event
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Mirror of the daemon's webhook body
+type WebhookBatch struct {
+	Node   string            `json:"node"`
+	Events []json.RawMessage `json:"events"`
+}
+
+var addr = flag.String("addr", "127.0.0.1:8080", "host:port to listen on")
+var secret = flag.String("secret", os.Getenv("SSMS_WEBHOOK_SECRET"), "key the bodies are signed with, empty to not verify")
+var fail = flag.Int("fail", 0, "respond 503 to the first n requests, to exercise retries")
+var delay = flag.Duration("delay", 0, "wait before responding, to simulate a slow receiver")
+
+func main() {
+	flag.Parse()
+	http.Handle("/", newReceiver(*secret, *fail, *delay, os.Stdout))
+	log.Printf("listening on %s", *addr)
+	if err := http.ListenAndServe(*addr, nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Handler printing the events of each batch to out, also used by tests
+// through httptest
+type receiver struct {
+	secret   string
+	fail     int
+	delay    time.Duration
+	mu       sync.Mutex
+	requests int
+	out      *json.Encoder
+}
+
+// Return a receiver verifying the bodies with secret unless empty, and
+// responding 503 to the first fail requests
+func newReceiver(secret string, fail int, delay time.Duration, out io.Writer) *receiver {
+	return &receiver{secret: secret, fail: fail, delay: delay, out: json.NewEncoder(out)}
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rc.secret != "" && !verify(rc.secret, r.Header.Get("X-SSMS-Signature"), body) {
+		log.Printf("%s %s: bad signature", r.RemoteAddr, r.URL.Path)
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+		return
+	}
+	rc.mu.Lock()
+	rc.requests++
+	n := rc.requests
+	rc.mu.Unlock()
+	time.Sleep(rc.delay)
+	if n <= rc.fail {
+		log.Printf("%s %s: failing request %d", r.RemoteAddr, r.URL.Path, n)
+		http.Error(w, "failing on purpose", http.StatusServiceUnavailable)
+		return
+	}
+	var batch WebhookBatch
+	if err := json.Unmarshal(body, &batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("%s %s: %d events from %s", r.RemoteAddr, r.URL.Path, len(batch.Events), batch.Node)
+	rc.mu.Lock()
+	for _, event := range batch.Events {
+		rc.out.Encode(event)
+	}
+	rc.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Check signature is the HMAC-SHA256 of body with secret
+func verify(secret string, signature string, body []byte) bool {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func post(t *testing.T, url, body, signature string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signature != "" {
+		req.Header.Set("X-SSMS-Signature", signature)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestReceiver(t *testing.T) {
+	log.SetOutput(io.Discard)
+	var out bytes.Buffer
+	server := httptest.NewServer(newReceiver("key", 1, 0, &out))
+	defer server.Close()
+	body := `{"node":"10.0.0.1","events":[{"type":"join"},{"type":"failed"}]}`
+
+	tests := []struct {
+		name      string
+		signature string
+		want      int
+	}{
+		{"unsigned", "", http.StatusUnauthorized},
+		{"wrong secret", sign("other", body), http.StatusUnauthorized},
+		{"failing on purpose", sign("key", body), http.StatusServiceUnavailable},
+		{"delivered", sign("key", body), http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		if got := post(t, server.URL, body, tt.signature); got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	want := "{\"type\":\"join\"}\n{\"type\":\"failed\"}\n"
+	if out.String() != want {
+		t.Errorf("printed %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,445 @@
+// Command ssmsctl drives a running SSMS daemon through its control socket
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Mirrors of the daemon's control RPC types
+type Empty struct{}
+
+type MemberInfo struct {
+	TimeStamp uint64            `json:"timestamp"`
+	IP        string            `json:"ip"`
+	State     string            `json:"state"`
+	Health    string            `json:"health"`
+	Flags     []string          `json:"flags,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	JoinedAt  time.Time         `json:"joined_at"`
+	ReclaimAt *time.Time        `json:"reclaim_at,omitempty"`
+	RTT       *time.Duration    `json:"rtt_ns,omitempty"`
+}
+
+type NodeInfo struct {
+	TimeStamp  uint64            `json:"timestamp"`
+	IP         string            `json:"ip"`
+	State      string            `json:"state"`
+	Joined     bool              `json:"joined"`
+	Members    int               `json:"members"`
+	Introducer string            `json:"introducer"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Health     string            `json:"health"`
+	Checks     []HealthResult    `json:"checks,omitempty"`
+
+	ProbeFanout   int           `json:"probe_fanout"`
+	ProbeInterval time.Duration `json:"probe_interval_ns"`
+}
+
+type HealthResult struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	Output    string    `json:"output,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type LeaveArgs struct {
+	Timeout time.Duration
+}
+
+type LeaveReply struct {
+	Confirmed bool
+}
+
+type MembersArgs struct {
+	All    bool
+	Tags   map[string]string
+	Near   string
+	Health []string
+}
+
+type MembersReply struct {
+	Members []MemberInfo
+}
+
+type ForceLeaveArgs struct {
+	IP        string
+	TimeStamp uint64
+}
+
+type LogLevelArgs struct {
+	Level string
+}
+
+type SetTagsArgs struct {
+	Tags map[string]string
+}
+
+type QueryArgs struct {
+	Name    string
+	Payload []byte
+	Tags    map[string]string
+	Node    string
+	States  []string
+	Timeout time.Duration
+	Ack     bool
+}
+
+type NodeResponse struct {
+	From      string    `json:"from"`
+	TimeStamp uint64    `json:"timestamp"`
+	Payload   []byte    `json:"payload"`
+	Time      time.Time `json:"time"`
+}
+
+type QueryReply struct {
+	Acks      []string
+	Responses []NodeResponse
+}
+
+type RTTArgs struct {
+	A string
+	B string
+}
+
+type RTTReply struct {
+	RTT time.Duration
+}
+
+type OwnersArgs struct {
+	Key string
+	N   int
+}
+
+type OwnersReply struct {
+	Owners []string
+}
+
+type LeaderReply struct {
+	Leader *MemberInfo
+	IsSelf bool
+}
+
+type UserEventArgs struct {
+	Name     string
+	Payload  []byte
+	Coalesce bool
+}
+
+// Repeatable key=value flag
+type tagsFlag map[string]string
+
+func (t tagsFlag) String() string {
+	return formatTags(t)
+}
+
+func (t tagsFlag) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("invalid tag %s, expect key=value", s)
+	}
+	t[key] = value
+	return nil
+}
+
+var socket = flag.String("socket", "/tmp/ssms.sock", "unix socket of the daemon")
+var addr = flag.String("addr", "", "loopback host:port of the daemon, overrides -socket")
+var format = flag.String("format", "table", "output format, table or json")
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: ssmsctl [flags] <command> [args]
+
+Commands:
+  join                      join the group
+  leave [-timeout 5s]       leave the group gracefully
+  members [-all] [-tag k=v] [-near ip] [-health healthy,degraded]
+                            list members, -all includes dead and left ones,
+                            -tag only those with the tag, repeatable, -near
+                            sorted by estimated RTT from ip or self
+  info                      show this node
+  force-leave <ip> [ts]     remove a failed member on its behalf
+  tags [-clear] [k=v ...]   show, replace or clear the tags of this node
+  event [-coalesce] <name> [payload]
+                            broadcast a user event to the group
+  query [-tag k=v] [-node regex] [-state alive] [-timeout 5s] [-ack] <name> [payload]
+                            ask the members passing the filters, wait for
+                            their responses until the timeout
+  rtt <ip> [ip]             estimate the RTT between two members, the
+                            second one is this node if omitted
+  owners [-n 3] <key>       list the members owning the key on the hash
+                            ring, primary first
+  leader                    show the elected leader
+  loglevel <level>          set the log level: debug, info, warn or error
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 || (*format != "table" && *format != "json") {
+		usage()
+		os.Exit(2)
+	}
+
+	client, err := dial()
+	if err != nil {
+		fail(err)
+	}
+	defer client.Close()
+
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+	switch cmd {
+	case "join":
+		call(client, "Control.Join", &Empty{}, &Empty{})
+		output(map[string]bool{"joined": true}, func() { fmt.Println("Joined") })
+
+	case "leave":
+		fs := flag.NewFlagSet("leave", flag.ExitOnError)
+		timeout := fs.Duration("timeout", 5*time.Second, "how long to wait for the leave to be acked")
+		fs.Parse(args)
+		var reply LeaveReply
+		call(client, "Control.Leave", &LeaveArgs{*timeout}, &reply)
+		output(map[string]bool{"confirmed": reply.Confirmed}, func() {
+			if reply.Confirmed {
+				fmt.Println("Leave confirmed")
+			} else {
+				fmt.Println("Leave not confirmed before timeout")
+			}
+		})
+
+	case "members":
+		fs := flag.NewFlagSet("members", flag.ExitOnError)
+		all := fs.Bool("all", false, "include dead and left members")
+		filter := make(tagsFlag)
+		fs.Var(filter, "tag", "only members with the key=value tag, repeatable")
+		near := fs.String("near", "", "sort by estimated RTT from this IP, or self")
+		health := fs.String("health", "", "only members of this comma separated health: healthy, degraded or unhealthy")
+		fs.Parse(args)
+		var healthFilter []string
+		if *health != "" {
+			healthFilter = strings.Split(*health, ",")
+		}
+		var reply MembersReply
+		call(client, "Control.Members", &MembersArgs{*all, filter, *near, healthFilter}, &reply)
+		output(reply.Members, func() { printMembers(reply.Members, *near != "") })
+
+	case "info":
+		var reply NodeInfo
+		call(client, "Control.Info", &Empty{}, &reply)
+		output(reply, func() { printInfo(reply) })
+
+	case "force-leave":
+		if len(args) < 1 {
+			usage()
+			os.Exit(2)
+		}
+		var ts uint64
+		if len(args) > 1 {
+			ts, err = strconv.ParseUint(args[1], 10, 64)
+			if err != nil {
+				fail(err)
+			}
+		}
+		call(client, "Control.ForceLeave", &ForceLeaveArgs{args[0], ts}, &Empty{})
+		output(map[string]string{"removed": args[0]}, func() { fmt.Println("Removed", args[0]) })
+
+	case "tags":
+		fs := flag.NewFlagSet("tags", flag.ExitOnError)
+		clearTags := fs.Bool("clear", false, "remove every tag")
+		fs.Parse(args)
+		var reply NodeInfo
+		if fs.NArg() == 0 && !*clearTags {
+			call(client, "Control.Info", &Empty{}, &reply)
+		} else {
+			tags := make(tagsFlag)
+			for _, pair := range fs.Args() {
+				if err := tags.Set(pair); err != nil {
+					fail(err)
+				}
+			}
+			call(client, "Control.SetTags", &SetTagsArgs{tags}, &reply)
+		}
+		output(reply.Tags, func() { fmt.Println(formatTags(reply.Tags)) })
+
+	case "event":
+		fs := flag.NewFlagSet("event", flag.ExitOnError)
+		coalesce := fs.Bool("coalesce", false, "deliver only the latest event of this name")
+		fs.Parse(args)
+		if fs.NArg() < 1 {
+			usage()
+			os.Exit(2)
+		}
+		name, payload := fs.Arg(0), strings.Join(fs.Args()[1:], " ")
+		call(client, "Control.UserEvent", &UserEventArgs{name, []byte(payload), *coalesce}, &Empty{})
+		output(map[string]string{"sent": name}, func() { fmt.Println("Sent", name) })
+
+	case "query":
+		fs := flag.NewFlagSet("query", flag.ExitOnError)
+		filter := make(tagsFlag)
+		fs.Var(filter, "tag", "only members with the key=value tag, repeatable")
+		node := fs.String("node", "", "only members whose IP matches the regex")
+		states := fs.String("state", "", "only members in these comma separated states")
+		timeout := fs.Duration("timeout", 5*time.Second, "how long to wait for responses")
+		ack := fs.Bool("ack", false, "ask the members to ack the query")
+		fs.Parse(args)
+		if fs.NArg() < 1 {
+			usage()
+			os.Exit(2)
+		}
+		query := QueryArgs{fs.Arg(0), []byte(strings.Join(fs.Args()[1:], " ")), filter, *node, nil, *timeout, *ack}
+		if *states != "" {
+			query.States = strings.Split(*states, ",")
+		}
+		var reply QueryReply
+		call(client, "Control.Query", &query, &reply)
+		output(reply, func() { printQuery(reply) })
+
+	case "rtt":
+		if len(args) < 1 {
+			usage()
+			os.Exit(2)
+		}
+		rttArgs := RTTArgs{A: args[0]}
+		if len(args) > 1 {
+			rttArgs.B = args[1]
+		}
+		var reply RTTReply
+		call(client, "Control.RTT", &rttArgs, &reply)
+		output(map[string]interface{}{"a": rttArgs.A, "b": rttArgs.B, "rtt_ns": reply.RTT}, func() { fmt.Println(reply.RTT) })
+
+	case "owners":
+		fs := flag.NewFlagSet("owners", flag.ExitOnError)
+		n := fs.Int("n", 0, "number of owners, the replication factor of the ring if 0")
+		fs.Parse(args)
+		if fs.NArg() < 1 {
+			usage()
+			os.Exit(2)
+		}
+		var reply OwnersReply
+		call(client, "Control.Owners", &OwnersArgs{fs.Arg(0), *n}, &reply)
+		output(reply.Owners, func() { fmt.Println(strings.Join(reply.Owners, "\n")) })
+
+	case "leader":
+		var reply LeaderReply
+		call(client, "Control.Leader", &Empty{}, &reply)
+		output(reply, func() {
+			if reply.Leader == nil {
+				fmt.Println("No leader")
+			} else {
+				fmt.Printf("%s\t%d\tself: %t\n", reply.Leader.IP, reply.Leader.TimeStamp, reply.IsSelf)
+			}
+		})
+
+	case "loglevel":
+		if len(args) < 1 {
+			usage()
+			os.Exit(2)
+		}
+		call(client, "Control.SetLogLevel", &LogLevelArgs{args[0]}, &Empty{})
+		output(map[string]string{"level": args[0]}, func() { fmt.Println("Log level set to", args[0]) })
+
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func dial() (*rpc.Client, error) {
+	if *addr != "" {
+		return jsonrpc.Dial("tcp", *addr)
+	}
+	return jsonrpc.Dial("unix", *socket)
+}
+
+func call(client *rpc.Client, method string, args interface{}, reply interface{}) {
+	if err := client.Call(method, args, reply); err != nil {
+		fail(err)
+	}
+}
+
+// Print v as JSON, or call table to print it for humans
+func output(v interface{}, table func()) {
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(v)
+		return
+	}
+	table()
+}
+
+func printMembers(members []MemberInfo, rtt bool) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	header := "IP\tTIMESTAMP\tSTATE\tHEALTH\tFLAGS\tJOINED\tTAGS"
+	if rtt {
+		header += "\tRTT"
+	}
+	fmt.Fprintln(w, header)
+	for _, m := range members {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s", m.IP, m.TimeStamp, m.State, m.Health,
+			strings.Join(m.Flags, ","), m.JoinedAt.Local().Format(time.RFC3339), formatTags(m.Tags))
+		if rtt && m.RTT != nil {
+			fmt.Fprintf(w, "\t%s", *m.RTT)
+		} else if rtt {
+			fmt.Fprint(w, "\tunknown")
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+}
+
+func printQuery(reply QueryReply) {
+	if len(reply.Acks) > 0 {
+		fmt.Printf("Acks (%d): %s\n", len(reply.Acks), strings.Join(reply.Acks, ", "))
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FROM\tRESPONSE")
+	for _, r := range reply.Responses {
+		fmt.Fprintf(w, "%s\t%s\n", r.From, r.Payload)
+	}
+	w.Flush()
+}
+
+func printInfo(info NodeInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "IP\t%s\n", info.IP)
+	fmt.Fprintf(w, "TimeStamp\t%d\n", info.TimeStamp)
+	fmt.Fprintf(w, "State\t%s\n", info.State)
+	fmt.Fprintf(w, "Joined\t%t\n", info.Joined)
+	fmt.Fprintf(w, "Members\t%d\n", info.Members)
+	fmt.Fprintf(w, "Introducer\t%s\n", info.Introducer)
+	fmt.Fprintf(w, "Tags\t%s\n", formatTags(info.Tags))
+	fmt.Fprintf(w, "Probing\t%d every %s\n", info.ProbeFanout, info.ProbeInterval)
+	fmt.Fprintf(w, "Health\t%s\n", info.Health)
+	for _, check := range info.Checks {
+		fmt.Fprintf(w, "  %s\t%s %s\n", check.Name, check.Status, check.Output)
+	}
+	w.Flush()
+}
+
+// Format tags as key=value pairs sorted by key
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for key, value := range tags {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "ssmsctl:", err)
+	os.Exit(1)
+}
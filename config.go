@@ -0,0 +1,173 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"time"
+)
+
+// Runtime configuration, filled from command line flags
+type SsmsConfig struct {
+	TombstonePeriod time.Duration
+	RPCSocket       string
+	RPCAddr         string
+	HTTPAddr        string
+	LogLevel        string
+	LogFormat       string
+	LogOutput       string
+	LogMaxSize      int64
+	LogMaxBackups   int
+	DNSAddr         string
+	DNSCluster      string
+	DNSTTL          time.Duration
+	DNSServicePort  int
+	Tags            Tags
+	EventHandlers   []string
+	HandlerTimeout  time.Duration
+	Webhooks        []string
+	WebhookSecret   string
+	WebhookBatch    time.Duration
+	WebhookRetries  int
+	WebhookQueue    int
+	Snapshot        string
+	RingVNodes      int
+	RingReplicas    int
+	RingWeightTag   string
+	Election        string
+	ElectionTag     string
+	ReconnectPeriod time.Duration
+	ReconnectLimit  time.Duration
+	TCPFallback     bool
+	HealthChecks    []string
+	HealthInterval  time.Duration
+	HealthTimeout   time.Duration
+	SendPacketRate  float64
+	SendByteRate    float64
+	RecvPacketRate  float64
+	ProbeFanout     int
+	ProbeInterval   time.Duration
+	ProbeTarget     time.Duration
+}
+
+var Conf = SsmsConfig{
+	TombstonePeriod: TombstonePeriod,
+	RPCSocket:       "/tmp/ssms.sock",
+	LogLevel:        "info",
+	LogFormat:       "logfmt",
+	LogOutput:       "./ssms.log",
+	LogMaxSize:      100,
+	LogMaxBackups:   3,
+	DNSCluster:      "default",
+	DNSServicePort:  6666,
+	HandlerTimeout:  HandlerTimeout,
+	WebhookSecret:   os.Getenv("SSMS_WEBHOOK_SECRET"),
+	WebhookBatch:    1000 * time.Millisecond,
+	WebhookRetries:  5,
+	WebhookQueue:    1024,
+	RingVNodes:      RingVNodes,
+	RingReplicas:    RingReplicas,
+	RingWeightTag:   "weight",
+	ElectionTag:     "priority",
+	ReconnectPeriod: 10000 * time.Millisecond,
+	ReconnectLimit:  3600000 * time.Millisecond,
+	HealthInterval:  10000 * time.Millisecond,
+	HealthTimeout:   5000 * time.Millisecond,
+	ProbeFanout:     1,
+	ProbeInterval:   PingSendingPeriod,
+}
+
+// Repeatable string flag
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// Parse command line flags into Conf
+func parseFlags() {
+	flag.DurationVar(&Conf.TombstonePeriod, "tombstone-period", Conf.TombstonePeriod,
+		"how long dead and left members are remembered")
+	flag.StringVar(&Conf.RPCSocket, "rpc-socket", Conf.RPCSocket,
+		"unix socket serving the control RPC, empty to disable")
+	flag.StringVar(&Conf.RPCAddr, "rpc-addr", Conf.RPCAddr,
+		"loopback host:port also serving the control RPC, empty to disable")
+	flag.StringVar(&Conf.HTTPAddr, "http-addr", Conf.HTTPAddr,
+		"host:port serving the HTTP admin API, empty to disable")
+	flag.StringVar(&Conf.LogLevel, "log-level", Conf.LogLevel,
+		"log level: debug, info, warn or error")
+	flag.StringVar(&Conf.LogFormat, "log-format", Conf.LogFormat,
+		"log format: logfmt or json")
+	flag.StringVar(&Conf.LogOutput, "log-output", Conf.LogOutput,
+		"log destination: a file path, stderr or syslog")
+	flag.Int64Var(&Conf.LogMaxSize, "log-max-size", Conf.LogMaxSize,
+		"size in MB at which the log file is rotated, 0 to never rotate")
+	flag.IntVar(&Conf.LogMaxBackups, "log-max-backups", Conf.LogMaxBackups,
+		"rotated log files to keep")
+	flag.StringVar(&Conf.DNSAddr, "dns-addr", Conf.DNSAddr,
+		"host:port serving the DNS zone over UDP and TCP, empty to disable")
+	flag.StringVar(&Conf.DNSCluster, "dns-cluster", Conf.DNSCluster,
+		"cluster name, members are served as <cluster>.ssms.")
+	flag.DurationVar(&Conf.DNSTTL, "dns-ttl", Conf.DNSTTL,
+		"TTL of the DNS records")
+	flag.IntVar(&Conf.DNSServicePort, "dns-service-port", Conf.DNSServicePort,
+		"port advertised in the SRV records")
+	flag.Var(&Conf.Tags, "tag",
+		"key=value tag advertised to the other members, repeatable")
+	flag.Var((*stringsFlag)(&Conf.EventHandlers), "event-handler",
+		"[filter,...=]command run on the events matching the filters, repeatable")
+	flag.DurationVar(&Conf.HandlerTimeout, "event-handler-timeout", Conf.HandlerTimeout,
+		"how long an event handler may run before it is killed")
+	flag.Var((*stringsFlag)(&Conf.Webhooks), "webhook",
+		"[filter,...=]url posted the membership events matching the filters, repeatable")
+	flag.StringVar(&Conf.WebhookSecret, "webhook-secret", Conf.WebhookSecret,
+		"key signing the webhook bodies with HMAC-SHA256, defaults to $SSMS_WEBHOOK_SECRET")
+	flag.DurationVar(&Conf.WebhookBatch, "webhook-batch", Conf.WebhookBatch,
+		"how long events are gathered into one webhook request")
+	flag.IntVar(&Conf.WebhookRetries, "webhook-retries", Conf.WebhookRetries,
+		"retries of a failed webhook request, with exponential backoff")
+	flag.IntVar(&Conf.WebhookQueue, "webhook-queue", Conf.WebhookQueue,
+		"events queued per webhook, further events are dropped")
+	flag.StringVar(&Conf.Snapshot, "snapshot", Conf.Snapshot,
+		"file the known members are kept in, to rejoin through them after a restart")
+	flag.IntVar(&Conf.RingVNodes, "ring-vnodes", Conf.RingVNodes,
+		"virtual nodes of a member of weight 1 on the hash ring")
+	flag.IntVar(&Conf.RingReplicas, "ring-replicas", Conf.RingReplicas,
+		"owners of a key on the hash ring, unless asked for another number")
+	flag.StringVar(&Conf.RingWeightTag, "ring-weight-tag", Conf.RingWeightTag,
+		"tag holding the weight of a member on the hash ring, 1 if missing")
+	flag.StringVar(&Conf.Election, "election", Conf.Election,
+		"leader election rule: oldest, lowest-ip or priority, empty to disable")
+	flag.StringVar(&Conf.ElectionTag, "election-tag", Conf.ElectionTag,
+		"tag holding the priority of a member for the priority rule, the highest leads")
+	flag.DurationVar(&Conf.ReconnectPeriod, "reconnect-interval", Conf.ReconnectPeriod,
+		"how often a failed member is contacted to heal a partition, 0 to disable")
+	flag.DurationVar(&Conf.ReconnectLimit, "reconnect-timeout", Conf.ReconnectLimit,
+		"how long failed members are contacted again")
+	flag.BoolVar(&Conf.TCPFallback, "tcp-fallback", Conf.TCPFallback,
+		"probe over TCP a member whose UDP ping timed out before suspecting it, and answer such probes")
+	flag.Var((*stringsFlag)(&Conf.HealthChecks), "health-check",
+		"[name=]http://host/path, [name=]tcp://host:port or [name=]exec:command checking the service of this node, repeatable")
+	flag.DurationVar(&Conf.HealthInterval, "health-interval", Conf.HealthInterval,
+		"how often the health checks run")
+	flag.DurationVar(&Conf.HealthTimeout, "health-timeout", Conf.HealthTimeout,
+		"time after which a health check fails")
+	flag.IntVar(&Conf.ProbeFanout, "probe-fanout", Conf.ProbeFanout,
+		"members probed every probe interval")
+	flag.DurationVar(&Conf.ProbeInterval, "probe-interval", Conf.ProbeInterval,
+		"interval between probes, unless -probe-target is set")
+	flag.DurationVar(&Conf.ProbeTarget, "probe-target", Conf.ProbeTarget,
+		"time within which every member is probed, the probe interval adapts to the group size, 0 for a fixed interval")
+	flag.Float64Var(&Conf.SendPacketRate, "send-packet-rate", Conf.SendPacketRate,
+		"packets sent per second at most, those over it are dropped, 0 for no limit")
+	flag.Float64Var(&Conf.SendByteRate, "send-byte-rate", Conf.SendByteRate,
+		"bytes sent per second at most, packets over it are dropped, 0 for no limit")
+	flag.Float64Var(&Conf.RecvPacketRate, "recv-packet-rate", Conf.RecvPacketRate,
+		"packets accepted per second from each source IP, those over it are dropped, 0 for no limit")
+	flag.Parse()
+}
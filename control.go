@@ -0,0 +1,378 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"sync"
+	"time"
+)
+
+// Member as reported to the control clients
+type MemberInfo struct {
+	TimeStamp uint64         `json:"timestamp"`
+	IP        string         `json:"ip"`
+	State     string         `json:"state"`
+	Health    string         `json:"health"`
+	Flags     []string       `json:"flags,omitempty"`
+	Tags      Tags           `json:"tags,omitempty"`
+	JoinedAt  time.Time      `json:"joined_at"`
+	ReclaimAt *time.Time     `json:"reclaim_at,omitempty"`
+	RTT       *time.Duration `json:"rtt_ns,omitempty"`
+}
+
+// This node as reported to the control clients
+type NodeInfo struct {
+	TimeStamp  uint64         `json:"timestamp"`
+	IP         string         `json:"ip"`
+	State      string         `json:"state"`
+	Joined     bool           `json:"joined"`
+	Members    int            `json:"members"`
+	Introducer string         `json:"introducer"`
+	Tags       Tags           `json:"tags,omitempty"`
+	Health     string         `json:"health"`
+	Checks     []HealthResult `json:"checks,omitempty"`
+	// Probing as chosen for the current group size
+	ProbeFanout   int           `json:"probe_fanout"`
+	ProbeInterval time.Duration `json:"probe_interval_ns"`
+}
+
+func memberInfo(m Member) MemberInfo {
+	info := MemberInfo{
+		TimeStamp: m.TimeStamp,
+		IP:        int2ip(m.IP).String(),
+		State:     stateName(m.State),
+		Health:    healthName(m.State),
+		Tags:      m.Tags(),
+		JoinedAt:  time.Unix(0, int64(m.TimeStamp)).UTC(),
+	}
+	if m.State&StateIntro != 0 {
+		info.Flags = append(info.Flags, "introducer")
+	}
+	if m.State&StateMonit != 0 {
+		info.Flags = append(info.Flags, "monitor")
+	}
+	return info
+}
+
+// Return the live members, followed by the tombstones if all is set,
+// having every tag of filter
+func memberInfos(all bool, filter Tags) []MemberInfo {
+	infos := make([]MemberInfo, 0)
+	for _, m := range CurrentList.Snapshot() {
+		if m.Tags().Match(filter) {
+			infos = append(infos, memberInfo(m))
+		}
+	}
+	if all {
+		for _, t := range CurrentList.Tombstones() {
+			if !t.Member.Tags().Match(filter) {
+				continue
+			}
+			info := memberInfo(t.Member)
+			reclaimAt := t.ReclaimAt.UTC()
+			info.ReclaimAt = &reclaimAt
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+func selfInfo() NodeInfo {
+	self := getCurrentMember()
+	return NodeInfo{
+		TimeStamp:  self.TimeStamp,
+		IP:         LocalIP,
+		State:      stateName(self.State),
+		Joined:     isJoined(),
+		Members:    CurrentList.Size(),
+		Introducer: IntroducerIP,
+		Tags:       self.Tags(),
+		Health:     healthName(self.State),
+		Checks:     HealthResults(),
+
+		ProbeFanout:   probeFanout(),
+		ProbeInterval: ProbeInterval(),
+	}
+}
+
+// RPC service served on the control socket, see cmd/ssmsctl
+type Control struct{}
+
+type Empty struct{}
+
+type LeaveArgs struct {
+	Timeout time.Duration
+}
+
+type LeaveReply struct {
+	Confirmed bool
+}
+
+type MembersArgs struct {
+	All    bool
+	Tags   Tags
+	Near   string
+	Health []string
+}
+
+type MembersReply struct {
+	Members []MemberInfo
+}
+
+type ForceLeaveArgs struct {
+	IP        string
+	TimeStamp uint64
+}
+
+type LogLevelArgs struct {
+	Level string
+}
+
+type SetTagsArgs struct {
+	Tags Tags
+}
+
+type QueryArgs struct {
+	Name    string
+	Payload []byte
+	Tags    Tags
+	Node    string
+	States  []string
+	Timeout time.Duration
+	Ack     bool
+}
+
+type QueryReply struct {
+	Acks      []string
+	Responses []NodeResponse
+}
+
+type RTTArgs struct {
+	A string
+	B string
+}
+
+type RTTReply struct {
+	RTT time.Duration
+}
+
+type OwnersArgs struct {
+	Key string
+	N   int
+}
+
+type OwnersReply struct {
+	Owners []string
+}
+
+type LeaderReply struct {
+	Leader *MemberInfo
+	IsSelf bool
+}
+
+type UserEventArgs struct {
+	Name     string
+	Payload  []byte
+	Coalesce bool
+}
+
+func (c *Control) Join(args *Empty, reply *Empty) error {
+	return Join()
+}
+
+func (c *Control) Leave(args *LeaveArgs, reply *LeaveReply) error {
+	if CurrentList.Size() < 1 {
+		return errNotJoined
+	}
+	timeout := args.Timeout
+	if timeout <= 0 {
+		timeout = LeaveTimeoutPeriod
+	}
+	reply.Confirmed = Leave(timeout)
+	return nil
+}
+
+func (c *Control) Members(args *MembersArgs, reply *MembersReply) error {
+	reply.Members = make([]MemberInfo, 0)
+	for _, m := range memberInfos(args.All, args.Tags) {
+		if healthMatch(args.Health, m) {
+			reply.Members = append(reply.Members, m)
+		}
+	}
+	if args.Near != "" {
+		return sortByDistance(args.Near, reply.Members)
+	}
+	return nil
+}
+
+// Estimate the RTT between the members A and B, this node if empty
+func (c *Control) RTT(args *RTTArgs, reply *RTTReply) error {
+	rtt, err := EstimateRTT(args.A, args.B)
+	reply.RTT = rtt
+	return err
+}
+
+func (c *Control) Info(args *Empty, reply *NodeInfo) error {
+	*reply = selfInfo()
+	return nil
+}
+
+func (c *Control) ForceLeave(args *ForceLeaveArgs, reply *Empty) error {
+	return ForceLeave(args.IP, args.TimeStamp)
+}
+
+func (c *Control) SetTags(args *SetTagsArgs, reply *NodeInfo) error {
+	if err := SetTags(args.Tags); err != nil {
+		return err
+	}
+	*reply = selfInfo()
+	return nil
+}
+
+func (c *Control) UserEvent(args *UserEventArgs, reply *Empty) error {
+	return SendUserEvent(args.Name, args.Payload, args.Coalesce)
+}
+
+// Block until the deadline of the query, then reply every ack and response
+func (c *Control) Query(args *QueryArgs, reply *QueryReply) error {
+	param := QueryParam{args.Tags, args.Node, args.States, args.Timeout, args.Ack}
+	result, err := Query(args.Name, args.Payload, param)
+	if err != nil {
+		return err
+	}
+	reply.Acks, reply.Responses = result.Collect()
+	return nil
+}
+
+// Return the members owning a key on the hash ring, primary first
+func (c *Control) Owners(args *OwnersArgs, reply *OwnersReply) error {
+	reply.Owners = CurrentRing.Owners(args.Key, args.N)
+	return nil
+}
+
+// Return the elected leader, nil if there is none
+func (c *Control) Leader(args *Empty, reply *LeaderReply) error {
+	leader, ok, err := Leader()
+	if ok {
+		reply.Leader = &leader
+		reply.IsSelf = isSelf(&leader)
+	}
+	return err
+}
+
+func (c *Control) SetLogLevel(args *LogLevelArgs, reply *Empty) error {
+	level, err := ParseLogLevel(args.Level)
+	if err != nil {
+		return err
+	}
+	return SetLogLevel(level)
+}
+
+// Open control listeners and their connections, closed by stopControl
+var controlListeners []net.Listener
+var controlConns = make(map[net.Conn]bool)
+var controlConnsMutex sync.Mutex
+
+// Serve the control RPC on the unix socket Conf.RPCSocket and
+// on the loopback TCP address Conf.RPCAddr, if configured
+func startControl() {
+	server := rpc.NewServer()
+	server.Register(new(Control))
+
+	if Conf.RPCSocket != "" {
+		listener, err := listenUnix(Conf.RPCSocket)
+		if err != nil {
+			printError(err)
+			fmt.Println(err)
+		} else {
+			serveControl(server, listener)
+		}
+	}
+	if Conf.RPCAddr != "" {
+		listener, err := listenLoopback(Conf.RPCAddr)
+		if err != nil {
+			printError(err)
+			fmt.Println(err)
+		} else {
+			serveControl(server, listener)
+		}
+	}
+}
+
+// Listen on a unix socket accessible to the owner only.
+// A stale socket left by a crashed daemon is removed
+func listenUnix(path string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, errors.New("Control socket " + path + " is in use")
+	}
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Listen on a TCP address, which must be a loopback one
+func listenLoopback(addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsLoopback() {
+		return nil, errors.New("Control address " + addr + " is not a loopback address")
+	}
+	return net.Listen("tcp", addr)
+}
+
+func serveControl(server *rpc.Server, listener net.Listener) {
+	controlConnsMutex.Lock()
+	controlListeners = append(controlListeners, listener)
+	controlConnsMutex.Unlock()
+	Logger.Info("Control listening", F("addr", listener.Addr().String()))
+
+	goDaemon(func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				// The listener is closed on shutdown
+				if daemonCtx.Err() == nil {
+					printError(err)
+				}
+				return
+			}
+			controlConnsMutex.Lock()
+			controlConns[conn] = true
+			controlConnsMutex.Unlock()
+			goDaemon(func() {
+				server.ServeCodec(jsonrpc.NewServerCodec(conn))
+				controlConnsMutex.Lock()
+				delete(controlConns, conn)
+				controlConnsMutex.Unlock()
+			})
+		}
+	})
+}
+
+// Close the control listeners and connections
+func stopControl() {
+	controlConnsMutex.Lock()
+	defer controlConnsMutex.Unlock()
+	for _, listener := range controlListeners {
+		listener.Close()
+	}
+	controlListeners = nil
+	for conn := range controlConns {
+		conn.Close()
+	}
+}
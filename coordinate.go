@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Vivaldi parameters, as in "Vivaldi: A Decentralized Network Coordinate
+// System" with the height, adjustment and gravity of "Network Coordinates
+// in the Wild". Distances are in seconds
+const (
+	VivaldiDimension  = 8
+	VivaldiErrorMax   = 1.5
+	VivaldiCE         = 0.25
+	VivaldiCC         = 0.25
+	VivaldiHeightMin  = 10e-6
+	VivaldiGravityRho = 150.0
+	VivaldiWindow     = 20
+	VivaldiFilterSize = 3
+	VivaldiZero       = 1.0e-6
+	VivaldiMaxRTT     = 10 * time.Second
+)
+
+// A network coordinate, the estimated RTT between two members is
+// the distance between their coordinates
+type Coordinate struct {
+	Vec        []float64 `json:"vec"`
+	Error      float64   `json:"error"`
+	Adjustment float64   `json:"adjustment"`
+	Height     float64   `json:"height"`
+}
+
+func NewCoordinate() *Coordinate {
+	return &Coordinate{
+		Vec:    make([]float64, VivaldiDimension),
+		Error:  VivaldiErrorMax,
+		Height: VivaldiHeightMin,
+	}
+}
+
+func (c *Coordinate) clone() *Coordinate {
+	vec := make([]float64, len(c.Vec))
+	copy(vec, c.Vec)
+	return &Coordinate{vec, c.Error, c.Adjustment, c.Height}
+}
+
+// Return false for a coordinate which cannot be used, such as
+// a malformed one received from another member
+func (c *Coordinate) valid() bool {
+	if len(c.Vec) != VivaldiDimension {
+		return false
+	}
+	for _, v := range c.Vec {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	for _, v := range []float64{c.Error, c.Adjustment, c.Height} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the estimated RTT to other
+func (c *Coordinate) DistanceTo(other *Coordinate) time.Duration {
+	dist := c.rawDistanceTo(other)
+	if adjusted := dist + c.Adjustment + other.Adjustment; adjusted > 0 {
+		dist = adjusted
+	}
+	return time.Duration(dist * float64(time.Second))
+}
+
+func (c *Coordinate) rawDistanceTo(other *Coordinate) float64 {
+	return magnitude(diff(c.Vec, other.Vec)) + c.Height + other.Height
+}
+
+// Move the coordinate by force seconds, away from other if positive
+func (c *Coordinate) applyForce(force float64, other *Coordinate) {
+	unit, mag := unitVectorAt(c.Vec, other.Vec)
+	for i := range c.Vec {
+		c.Vec[i] += unit[i] * force
+	}
+	if mag > VivaldiZero {
+		c.Height = (c.Height+other.Height)*force/mag + c.Height
+		c.Height = math.Max(c.Height, VivaldiHeightMin)
+	}
+}
+
+func diff(a, b []float64) []float64 {
+	d := make([]float64, len(a))
+	for i := range a {
+		d[i] = a[i] - b[i]
+	}
+	return d
+}
+
+func magnitude(v []float64) float64 {
+	sum := 0.0
+	for _, x := range v {
+		sum += x * x
+	}
+	return math.Sqrt(sum)
+}
+
+// Return the unit vector from b to a and the distance between them,
+// a random direction if they are at the same place
+func unitVectorAt(a, b []float64) ([]float64, float64) {
+	d := diff(a, b)
+	mag := magnitude(d)
+	if mag > VivaldiZero {
+		for i := range d {
+			d[i] /= mag
+		}
+		return d, mag
+	}
+	for i := range d {
+		d[i] = rand.Float64() - 0.5
+	}
+	if m := magnitude(d); m > VivaldiZero {
+		for i := range d {
+			d[i] /= m
+		}
+		return d, 0
+	}
+	return make([]float64, len(a)), 0
+}
+
+// The coordinate of this node, and the last coordinates of the members
+// it probed, by IP
+type CoordinateClient struct {
+	mu          sync.Mutex
+	coord       *Coordinate
+	origin      *Coordinate
+	adjustments []float64
+	adjustIndex int
+	samples     map[string][]float64
+	peers       map[string]*Coordinate
+}
+
+var Coordinates = NewCoordinateClient()
+
+func NewCoordinateClient() *CoordinateClient {
+	return &CoordinateClient{
+		coord:       NewCoordinate(),
+		origin:      NewCoordinate(),
+		adjustments: make([]float64, VivaldiWindow),
+		samples:     make(map[string][]float64),
+		peers:       make(map[string]*Coordinate),
+	}
+}
+
+// Return a copy of the coordinate of this node
+func (cc *CoordinateClient) Get() *Coordinate {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.coord.clone()
+}
+
+// Return a copy of the coordinate of ip, nil if unknown
+func (cc *CoordinateClient) Peer(ip string) *Coordinate {
+	if ip == LocalIP {
+		return cc.Get()
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if coord, ok := cc.peers[ip]; ok {
+		return coord.clone()
+	}
+	return nil
+}
+
+// Return a copy of every known coordinate, this node's included
+func (cc *CoordinateClient) All() map[string]*Coordinate {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	all := make(map[string]*Coordinate, len(cc.peers)+1)
+	for ip, coord := range cc.peers {
+		all[ip] = coord.clone()
+	}
+	all[LocalIP] = cc.coord.clone()
+	return all
+}
+
+// Update the coordinate of this node with the coordinate of ip
+// and the RTT of a probe to it
+func (cc *CoordinateClient) Update(ip string, other *Coordinate, rtt time.Duration) {
+	if !other.valid() || rtt <= 0 || rtt > VivaldiMaxRTT {
+		return
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.peers[ip] = other
+
+	// The median of the last samples filters out the spikes
+	samples := append(cc.samples[ip], rtt.Seconds())
+	if len(samples) > VivaldiFilterSize {
+		samples = samples[1:]
+	}
+	cc.samples[ip] = samples
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	cc.updateVivaldi(other, median)
+	cc.updateAdjustment(other, median)
+	// Pull the coordinate back to the origin, so that it does not drift
+	dist := cc.origin.rawDistanceTo(cc.coord)
+	cc.coord.applyForce(-1.0*math.Pow(dist/VivaldiGravityRho, 2.0), cc.origin)
+	if !cc.coord.valid() {
+		Logger.Warn("Invalid coordinate, reset it", F("member", ip))
+		cc.coord = NewCoordinate()
+	}
+}
+
+func (cc *CoordinateClient) updateVivaldi(other *Coordinate, rtt float64) {
+	rtt = math.Max(rtt, VivaldiZero)
+	dist := cc.coord.rawDistanceTo(other)
+	wrongness := math.Abs(dist-rtt) / rtt
+
+	totalError := math.Max(cc.coord.Error+other.Error, VivaldiZero)
+	weight := cc.coord.Error / totalError
+	cc.coord.Error = VivaldiCC*weight*wrongness + cc.coord.Error*(1.0-VivaldiCC*weight)
+	cc.coord.Error = math.Min(cc.coord.Error, VivaldiErrorMax)
+
+	cc.coord.applyForce(VivaldiCE*weight*(rtt-dist), other)
+}
+
+// The adjustment is the mean error of the recent estimates, which
+// the plain Euclidean model cannot capture
+func (cc *CoordinateClient) updateAdjustment(other *Coordinate, rtt float64) {
+	cc.adjustments[cc.adjustIndex] = rtt - cc.coord.rawDistanceTo(other)
+	cc.adjustIndex = (cc.adjustIndex + 1) % VivaldiWindow
+	sum := 0.0
+	for _, sample := range cc.adjustments {
+		sum += sample
+	}
+	cc.coord.Adjustment = sum / (2.0 * VivaldiWindow)
+}
+
+// Return ip, or the IP of this node for "self" or an empty ip
+func resolveIP(ip string) string {
+	if ip == "" || ip == "self" {
+		return LocalIP
+	}
+	return ip
+}
+
+// Return the coordinate of the member at IP ip
+func memberCoordinate(ip string) (*Coordinate, error) {
+	if ip == LocalIP {
+		return Coordinates.Get(), nil
+	}
+	if net.ParseIP(ip) == nil {
+		return nil, errors.New("Invalid IP " + ip)
+	}
+	if coord := Coordinates.Peer(ip); coord != nil {
+		return coord, nil
+	}
+	return nil, errors.New("No coordinate for " + ip + " yet")
+}
+
+// Return the estimated RTT between the members at IPs a and b
+func EstimateRTT(a, b string) (time.Duration, error) {
+	a, b = resolveIP(a), resolveIP(b)
+	ca, err := memberCoordinate(a)
+	if err != nil {
+		return 0, err
+	}
+	cb, err := memberCoordinate(b)
+	if err != nil {
+		return 0, err
+	}
+	if a == b {
+		return 0, nil
+	}
+	return ca.DistanceTo(cb), nil
+}
+
+// Sort the members by estimated RTT from the member at IP from,
+// those with no coordinate come last. Set their RTT
+func sortByDistance(from string, members []MemberInfo) error {
+	from = resolveIP(from)
+	origin, err := memberCoordinate(from)
+	if err != nil {
+		return err
+	}
+	for i := range members {
+		if coord := Coordinates.Peer(members[i].IP); coord != nil {
+			rtt := origin.DistanceTo(coord)
+			if members[i].IP == from {
+				rtt = 0
+			}
+			members[i].RTT = &rtt
+		}
+	}
+	sort.SliceStable(members, func(i, j int) bool {
+		ri, rj := members[i].RTT, members[j].RTT
+		return ri != nil && (rj == nil || *ri < *rj)
+	})
+	return nil
+}
+
+// Write the coordinate as its dimension followed by float64s
+func writeCoordinate(buf *bytes.Buffer, c *Coordinate) {
+	buf.WriteByte(uint8(len(c.Vec)))
+	binary.Write(buf, binary.BigEndian, c.Vec)
+	binary.Write(buf, binary.BigEndian, []float64{c.Error, c.Adjustment, c.Height})
+}
+
+func readCoordinate(r *bytes.Reader) (*Coordinate, error) {
+	dim, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]float64, int(dim)+3)
+	if err := binary.Read(r, binary.BigEndian, values); err != nil {
+		return nil, err
+	}
+	return &Coordinate{values[:dim], values[dim], values[dim+1], values[dim+2]}, nil
+}
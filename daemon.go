@@ -1,14 +1,22 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	// "log"
 	"math/rand"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -21,10 +29,23 @@ const (
 	MemUpdateResume    = 0x01 << 5
 	MemUpdateLeave     = 0x01 << 6
 	MemUpdateJoin      = 0x01 << 7
+	MemUpdateExt       = MemUpdateLeave | MemUpdateJoin
+	MemUpdateMeta      = MemUpdateExt | 0x01
+	MemUpdateUserEvent = MemUpdateExt | 0x02
+	MemUpdateQuery     = MemUpdateExt | 0x03
+	MemUpdateHeal      = MemUpdateExt | 0x04
+	MemUpdateHealth    = MemUpdateExt | 0x05
+	AckUnknownSender   = 0x01 << 7
+	AckCoordinate      = 0x01 << 6
+	AckFailedSender    = 0x01 << 5
 	StateAlive         = 0x01
 	StateSuspect       = 0x01 << 1
 	StateMonit         = 0x01 << 2
 	StateIntro         = 0x01 << 3
+	StateDead          = 0x01 << 4
+	StateLeft          = 0x01 << 5
+	StateDegraded      = 0x01 << 6
+	StateUnhealthy     = 0x01 << 7
 	IntroducerIP       = "172.22.156.95"
 	Port               = ":6666"
 	InitTimeoutPeriod  = 2000 * time.Millisecond
@@ -33,16 +54,56 @@ const (
 	SuspectPeriod      = 1000 * time.Millisecond
 	PingIntroPeriod    = 5000 * time.Millisecond
 	UpdateDeletePeriod = 15000 * time.Millisecond
-	LeaveDelayPeriod   = 2000 * time.Millisecond
+	LeaveTimeoutPeriod = 5000 * time.Millisecond
+	TombstonePeriod    = 300000 * time.Millisecond
+	ShutdownPeriod     = 5000 * time.Millisecond
+	WatchKeepPeriod    = 15000 * time.Millisecond
+	WatchHistorySize   = 1024
+	WatchBufferSize    = 256
+	MaxMetadataSize    = 512
+	PacketBufferSize   = 65536
+	MaxUserEventSize   = 512
+	CoalescePeriod     = 500 * time.Millisecond
+	MaxQuerySize       = 512
+	MaxResponseSize    = 1024
+	QueryTimeoutPeriod = 5000 * time.Millisecond
+	HandlerTimeout     = 30000 * time.Millisecond
+	HandlerQueueSize   = 256
+	WebhookTimeout     = 10000 * time.Millisecond
+	WebhookBackoff     = 500 * time.Millisecond
+	MaxWebhookBackoff  = 30000 * time.Millisecond
+	MaxWebhookBatch    = 256
+	SnapshotMaxLines   = 1024
+	MaxJoinContacts    = 5
+	MaxPushPullSize    = 60000
+	TCPProbeTimeout    = 1000 * time.Millisecond
+	MaxRecvSources     = 4096
+	ThrottleLogPeriod  = 10000 * time.Millisecond
+	MinProbeInterval   = 50 * time.Millisecond
+	RingVNodes         = 128
+	RingReplicas       = 3
+	ElectionSettle     = 100 * time.Millisecond
+	HTTPHeaderTimeout  = 5000 * time.Millisecond
+	HTTPIdleTimeout    = 60000 * time.Millisecond
+	WireVersion        = 0x01 << 4
 	TTL_               = 3
 )
 
+// Every packet starts with WireVersion and is dropped by a node of
+// another version. Its Ping and Ack bits are clear, so nodes predating
+// the version ignore the packet, and their packets, starting with the
+// type, never match it. The Reserved field of acks holds
+// AckUnknownSender, AckCoordinate and AckFailedSender flags, that of
+// direct messages their kind
 type Header struct {
+	Version  uint8
 	Type     uint8
 	Seq      uint16
 	Reserved uint8
 }
 
+// Update types above MemUpdateExt are extended ones, they are sent
+// with the MemUpdateExt header flag and tell apart by UpdateType
 type Update struct {
 	UpdateID        uint64
 	TTL             uint8
@@ -50,24 +111,167 @@ type Update struct {
 	MemberTimeStamp uint64
 	MemberIP        uint32
 	MemberState     uint8
+	// Metadata of the member for join and metadata updates
+	Payload []byte
+}
+
+// Update on the wire, followed by PayloadLength bytes of payload
+type updateWire struct {
+	UpdateID        uint64
+	TTL             uint8
+	UpdateType      uint8
+	MemberTimeStamp uint64
+	MemberIP        uint32
+	MemberState     uint8
+	PayloadLength   uint16
+}
+
+// Member on the wire, followed by its metadata
+type memberWire struct {
+	TimeStamp uint64
+	IP        uint32
+	State     uint8
+}
+
+func writeUpdate(buf *bytes.Buffer, u *Update) {
+	wire := updateWire{u.UpdateID, u.TTL, u.UpdateType, u.MemberTimeStamp, u.MemberIP, u.MemberState, uint16(len(u.Payload))}
+	binary.Write(buf, binary.BigEndian, &wire)
+	buf.Write(u.Payload)
+}
+
+func readUpdate(payload []byte) (Update, error) {
+	buf := bytes.NewReader(payload)
+	var wire updateWire
+	if err := binary.Read(buf, binary.BigEndian, &wire); err != nil {
+		return Update{}, err
+	}
+	if int(wire.PayloadLength) > buf.Len() {
+		return Update{}, errors.New("Truncated update payload")
+	}
+	data := make([]byte, wire.PayloadLength)
+	buf.Read(data)
+	return Update{wire.UpdateID, wire.TTL, wire.UpdateType, wire.MemberTimeStamp, wire.MemberIP, wire.MemberState, data}, nil
+}
+
+func writeMember(buf *bytes.Buffer, m *Member) {
+	wire := memberWire{m.TimeStamp, m.IP, m.State}
+	binary.Write(buf, binary.BigEndian, &wire)
+	writeMetadata(buf, m.Meta)
+}
+
+func readMember(buf *bytes.Reader) (Member, error) {
+	var wire memberWire
+	if err := binary.Read(buf, binary.BigEndian, &wire); err != nil {
+		return Member{}, err
+	}
+	meta, err := readMetadata(buf)
+	if err != nil {
+		return Member{}, err
+	}
+	return Member{wire.TimeStamp, wire.IP, wire.State, meta}, nil
+}
+
+// Return the readable name of a message header type, such as
+// "ping", "ack" or "ping_suspect" for a ping carrying a suspect update
+func messageType(t uint8) string {
+	name := "unknown"
+	if t&(Ping|Ack) == Ping|Ack {
+		return "direct"
+	} else if t&Ping != 0 {
+		name = "ping"
+	} else if t&Ack != 0 {
+		name = "ack"
+	}
+	if t&MemInitRequest != 0 {
+		name += "_init_request"
+	} else if t&MemInitReply != 0 {
+		name += "_init_reply"
+	} else if t&0xf0 != 0 {
+		name += "_" + updateName(t&0xf0)
+	}
+	return name
+}
+
+// Return the readable name of an update type, such as "suspect"
+func updateName(t uint8) string {
+	switch t {
+	case MemUpdateSuspect:
+		return "suspect"
+	case MemUpdateResume:
+		return "resume"
+	case MemUpdateLeave:
+		return "leave"
+	case MemUpdateJoin:
+		return "join"
+	case MemUpdateExt:
+		return "extended"
+	case MemUpdateMeta:
+		return "meta"
+	case MemUpdateUserEvent:
+		return "user_event"
+	case MemUpdateQuery:
+		return "query"
+	case MemUpdateHeal:
+		return "heal"
+	case MemUpdateHealth:
+		return "health"
+	}
+	return "unknown"
 }
 
 var init_timer *time.Timer
 var PingAckTimeout map[uint16]*time.Timer
+var PingSentAt map[uint16]time.Time
 var FailureTimeout map[[2]uint64]*time.Timer
-var CurrentMember *Member
+
+// This node, replaced as a whole and never modified once stored, since
+// the probe, health, control and HTTP goroutines read it without a lock.
+// Writers hold controlMutex
+var currentMember atomic.Pointer[Member]
 var CurrentList *MemberList
 var LocalIP string
 
+// The listening socket, shared by every outbound datagram
+var UDPConn *net.UDPConn
+
 var DuplicateUpdateCaches map[uint64]uint8
 var TTLCaches *TtlCache
-var Logger *ssmsLogger
+var Logger LeveledLogger
 
-var global_wg sync.WaitGroup
+// Set while this daemon is in the group, probing and responding
+var joined int32
+
+// Cancelled on shutdown, every daemon goroutine is tracked by daemonWg
+var daemonCtx context.Context
+var daemonCancel context.CancelFunc
+var daemonWg sync.WaitGroup
+
+// Serializes join and leave, requested from console or control socket
+var controlMutex sync.Mutex
+
+var errAlreadyJoined = errors.New("Already in the group")
+var errNotJoined = errors.New("Haven't join the group")
+
+// Fired when the introducer does not reply the init request
+var initFailed = make(chan struct{}, 1)
+
+// Seq of the last ping, starting at random. Pings in flight never share
+// a seq, so that each ack reaches the timer and leave it belongs to
+var pingSeq = uint32(rand.Intn(0x01<<15 - 2))
+
+// mutex used for PingAckTimeout, PingSentAt and FailureTimeout
+var timerMutex sync.Mutex
 
 // mutex used for duplicate update caches write
 var mutex sync.Mutex
 
+// Outstanding leave broadcast pings, seq -> target IP
+// Acks of these pings are reported on leaveAcks
+var leaveSeqs map[uint16]uint32
+var leaveAcked map[uint32]bool
+var leaveAcks chan uint32
+var leaveMutex sync.Mutex
+
 // A trick to simply get local IP address
 func getLocalIP() net.IP {
 	dial, err := net.Dial("udp", "8.8.8.8:80")
@@ -97,16 +301,30 @@ func int2ip(binip uint32) net.IP {
 // Helper function to print the err in process
 func printError(err error) {
 	if err != nil {
-		Logger.Error(err.Error())
+		Logger.Error("Error", F("err", err))
 	}
 }
 
-// UDP send
+// UDP send through the listening socket, so that every datagram
+// originates from Port and no socket is created per packet
 func udpSend(addr string, packet []byte) {
-	conn, err := net.Dial("udp", addr)
-	printError(err)
-	defer conn.Close()
-	conn.Write(packet)
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		SendErrors.Inc()
+		printError(err)
+		return
+	}
+	if !allowSend(udpAddr.IP.String(), len(packet)) {
+		return
+	}
+	n, err := UDPConn.WriteToUDP(packet, udpAddr)
+	if err != nil {
+		SendErrors.Inc()
+		printError(err)
+		return
+	}
+	PacketsSent.With(messageType(packet[1])).Inc()
+	BytesSent.With(messageType(packet[1])).Add(uint64(n))
 }
 
 // UDP Daemon loop task
@@ -116,126 +334,610 @@ func udpDaemon() {
 	printError(err)
 	// Listen the request
 	listen, err := net.ListenUDP("udp", udpAddr)
-	printError(err)
-
-	// Use waitgroup
-	var wg sync.WaitGroup
-	wg.Add(1)
+	if err != nil {
+		printError(err)
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	UDPConn = listen
 
 	userCmd := make(chan string)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
+	// readCommand is not tracked, a blocking stdin read cannot be cancelled
 	go readCommand(userCmd)
 
-	global_wg.Add(1)
-	go udpDaemonHandle(listen)
-	go periodicPing()
-	go periodicPingIntroducer()
+	startControl()
+	startHTTP()
+	startDNS()
+	startTCPProbe(serverAddr)
+	startHealthChecks()
+	startHandlers()
+	startWebhooks()
+	startRing()
+	startElection()
+	rejoin := startSnapshot()
+
+	goDaemon(func() { udpDaemonHandle(listen) })
+	goDaemon(periodicPing)
+	goDaemon(periodicPingIntroducer)
+	startHealing()
+
+	if rejoin {
+		Logger.Info("Rejoin the group from the snapshot", F("path", Conf.Snapshot))
+		if err := Join(); err != nil {
+			fmt.Println(err)
+		}
+	}
 
 	for {
-		s := <-userCmd
-		switch s {
-		case "join":
-			if CurrentList.Size() > 0 {
-				fmt.Println("Already in the group")
-				continue
+		var s string
+		select {
+		case s = <-userCmd:
+		case sig := <-signals:
+			Logger.Info("Receive signal, shut down", F("signal", sig.String()))
+			if isJoined() {
+				Leave(LeaveTimeoutPeriod)
 			}
-			global_wg.Done()
-
-			if LocalIP == IntroducerIP {
-				CurrentMember.State |= (StateIntro | StateMonit)
-				CurrentList.Insert(CurrentMember)
-			} else {
-				// New member, send Init Request to the introducer
-				initRequest(CurrentMember)
+			shutdownWithin(ShutdownPeriod)
+			return
+		case <-initFailed:
+			shutdownWithin(ShutdownPeriod)
+			os.Exit(1)
+		}
+		args := strings.Fields(s)
+		if len(args) == 0 {
+			args = []string{""}
+		}
+		switch args[0] {
+		case "join":
+			if err := Join(); err != nil {
+				fmt.Println(err)
 			}
 
 		case "showlist":
-			CurrentList.PrintMemberList()
+			CurrentList.PrintMemberList(len(args) > 1 && args[1] == "--all")
 
 		case "showid":
-			fmt.Printf("Member (%d, %s)\n", CurrentMember.TimeStamp, LocalIP)
+			fmt.Printf("Member (%d, %s)\n", getCurrentMember().TimeStamp, LocalIP)
 
 		case "leave":
 			if CurrentList.Size() < 1 {
-				fmt.Println("Haven't join the group")
+				fmt.Println(errNotJoined)
+				continue
+			}
+			if Leave(LeaveTimeoutPeriod) {
+				fmt.Println("Leave confirmed")
+			} else {
+				fmt.Println("Leave not confirmed before timeout")
+			}
+
+		case "force-leave":
+			if len(args) < 2 {
+				fmt.Println("Usage: force-leave <ip> [timestamp]")
+				continue
+			}
+			var ts uint64
+			if len(args) > 2 {
+				ts, _ = strconv.ParseUint(args[2], 10, 64)
+			}
+			if err := ForceLeave(args[1], ts); err != nil {
+				fmt.Println(err)
+			}
+
+		case "tags":
+			if len(args) < 2 {
+				fmt.Printf("Tags: %s\n", getCurrentMember().Tags())
+				continue
+			}
+			var tags Tags
+			var err error
+			if args[1] != "--clear" {
+				tags, err = ParseTags(args[1:])
+			}
+			if err == nil {
+				err = SetTags(tags)
+			}
+			if err != nil {
+				fmt.Println(err)
+			}
+
+		case "event":
+			coalesce := len(args) > 1 && args[1] == "--coalesce"
+			if coalesce {
+				args = args[1:]
+			}
+			if len(args) < 2 {
+				fmt.Println("Usage: event [--coalesce] <name> [payload]")
+				continue
+			}
+			payload := strings.Join(args[2:], " ")
+			if err := SendUserEvent(args[1], []byte(payload), coalesce); err != nil {
+				fmt.Println(err)
+			}
+
+		case "query":
+			if err := consoleQuery(args[1:]); err != nil {
+				fmt.Println(err)
+			}
+
+		case "rtt":
+			if len(args) < 2 {
+				fmt.Println("Usage: rtt <ip> [ip]")
+				continue
+			}
+			other := ""
+			if len(args) > 2 {
+				other = args[2]
+			}
+			rtt, err := EstimateRTT(args[1], other)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Printf("Estimated RTT: %s\n", rtt)
+
+		case "nearest":
+			near := ""
+			if len(args) > 1 {
+				near = args[1]
+			}
+			members := memberInfos(false, nil)
+			if err := sortByDistance(near, members); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			for _, m := range members {
+				if m.RTT != nil {
+					fmt.Printf("%s\t%d\t%s\n", m.IP, m.TimeStamp, *m.RTT)
+				} else {
+					fmt.Printf("%s\t%d\tunknown\n", m.IP, m.TimeStamp)
+				}
+			}
+
+		case "owners":
+			if len(args) < 2 {
+				fmt.Println("Usage: owners <key> [n]")
+				continue
+			}
+			n := 0
+			if len(args) > 2 {
+				n, _ = strconv.Atoi(args[2])
+			}
+			fmt.Printf("Owners: %s\n", strings.Join(CurrentRing.Owners(args[1], n), ", "))
+
+		case "leader":
+			leader, ok, err := Leader()
+			if err != nil {
+				fmt.Println(err)
+			} else if !ok {
+				fmt.Println("No leader")
+			} else {
+				fmt.Printf("Leader (%d, %s), self: %t\n", leader.TimeStamp, leader.IP, isSelf(&leader))
+			}
+
+		case "loglevel":
+			if len(args) < 2 {
+				fmt.Println("Usage: loglevel <debug|info|warn|error>")
 				continue
 			}
-			global_wg.Add(1)
-			initiateLeave()
+			level, err := ParseLogLevel(args[1])
+			if err == nil {
+				err = SetLogLevel(level)
+			}
+			if err != nil {
+				fmt.Println(err)
+			}
 
 		default:
 			fmt.Println("Invalid Command, Please use correct one")
 			fmt.Println("# join")
-			fmt.Println("# showlist")
+			fmt.Println("# showlist [--all]")
 			fmt.Println("# showid")
 			fmt.Println("# leave")
+			fmt.Println("# force-leave <ip> [timestamp]")
+			fmt.Println("# tags [key=value ...|--clear]")
+			fmt.Println("# event [--coalesce] <name> [payload]")
+			fmt.Println("# query [--tag k=v] [--node regex] [--state alive] [--timeout 5s] [--ack] <name> [payload]")
+			fmt.Println("# rtt <ip> [ip]")
+			fmt.Println("# nearest [ip]")
+			fmt.Println("# owners <key> [n]")
+			fmt.Println("# leader")
+			fmt.Println("# loglevel <debug|info|warn|error>")
+		}
+	}
+}
+
+// Run f in a goroutine tracked by daemonWg
+func goDaemon(f func()) {
+	daemonWg.Add(1)
+	go func() {
+		defer daemonWg.Done()
+		f()
+	}()
+}
+
+// Run f once d elapsed, unless the returned timer is stopped or the
+// daemon shuts down first. Stopping the timer releases f at once
+func afterTimer(d time.Duration, f func()) *time.Timer {
+	ctx := daemonCtx
+	return time.AfterFunc(d, func() {
+		if ctx.Err() == nil {
+			f()
 		}
+	})
+}
+
+// Sleep for d, return false if the daemon shuts down meanwhile
+func sleepDaemon(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-daemonCtx.Done():
+		return false
+	}
+}
+
+func getCurrentMember() *Member {
+	return currentMember.Load()
+}
+
+func setCurrentMember(m *Member) {
+	currentMember.Store(m)
+}
+
+// Return true if the member is this node's current identity
+func isCurrentMember(ts uint64, ip uint32) bool {
+	self := getCurrentMember()
+	return self.TimeStamp == ts && self.IP == ip
+}
+
+func isJoined() bool {
+	return atomic.LoadInt32(&joined) == 1
+}
+
+func setJoined(in bool) {
+	if in {
+		atomic.StoreInt32(&joined, 1)
+	} else {
+		atomic.StoreInt32(&joined, 0)
+	}
+}
+
+// Stop every daemon goroutine and timer, close the socket and flush the
+// log. Return ctx.Err() if the goroutines did not exit before ctx is done
+func Shutdown(ctx context.Context) error {
+	setJoined(false)
+	daemonCancel()
+
+	timerMutex.Lock()
+	for seq, timer := range PingAckTimeout {
+		timer.Stop()
+		delete(PingAckTimeout, seq)
+	}
+	for key, timer := range FailureTimeout {
+		timer.Stop()
+		delete(FailureTimeout, key)
 	}
+	timerMutex.Unlock()
+	if init_timer != nil {
+		init_timer.Stop()
+	}
+	if UDPConn != nil {
+		UDPConn.Close()
+	}
+	closeQueries()
+	stopControl()
+	stopHTTP(ctx)
+	stopDNS()
+	stopTCPProbe()
 
-	wg.Wait()
+	done := make(chan struct{})
+	go func() {
+		daemonWg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+		Logger.Info("Service shut down")
+		closeLogger()
+	case <-ctx.Done():
+		err = ctx.Err()
+		Logger.Error("Service shut down", F("err", err))
+		// The goroutines left may still log
+		go func() {
+			<-done
+			closeLogger()
+		}()
+	}
+	return err
 }
 
-// Concurrently read user input by chanel
+func shutdownWithin(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := Shutdown(ctx); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Concurrently read user input lines by chanel
 func readCommand(input chan<- string) {
-	for {
-		var cmd string
-		_, err := fmt.Scanln(&cmd)
-		if err != nil {
-			fmt.Println(err)
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		select {
+		case input <- scanner.Text():
+		case <-daemonCtx.Done():
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Join the group. The introducer inserts itself,
+// others send an init request to the introducer
+func Join() error {
+	controlMutex.Lock()
+	defer controlMutex.Unlock()
+	if isJoined() || CurrentList.Size() > 0 {
+		return errAlreadyJoined
+	}
+	setJoined(true)
+
+	if LocalIP == IntroducerIP {
+		self := *getCurrentMember()
+		self.State |= (StateIntro | StateMonit)
+		setCurrentMember(&self)
+		// The list keeps its own copy
+		member := self
+		CurrentList.Insert(&member)
+	} else {
+		// New member, send Init Request to the known members
+		// and the introducer, until one replies
+		initRequest(getCurrentMember(), joinContacts())
+	}
+	return nil
+}
+
+// Remove a member, typically a failed one, from the group on its behalf
+// by disseminating a leave update for it. If ts is 0, every member with
+// the IP is removed
+func ForceLeave(ip string, ts uint64) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() == nil {
+		return errors.New("Invalid IP " + ip)
+	}
+	found := false
+	for _, member := range CurrentList.Snapshot() {
+		if member.IP != ip2int(parsed) || (ts != 0 && member.TimeStamp != ts) {
+			continue
+		}
+		if isCurrentMember(member.TimeStamp, member.IP) {
+			return errors.New("Cannot force leave self, use leave")
 		}
-		input <- cmd
+		Logger.Info("Force member to leave", F("member", ip), F("ts", member.TimeStamp))
+		CurrentList.MarkDead(member.TimeStamp, member.IP, StateLeft)
+		addUpdate2Cache(&member, MemUpdateLeave)
+		found = true
+	}
+	if !found {
+		return errors.New("No such member " + ip)
+	}
+	return nil
+}
+
+// Rejoin with a new identity after a member declared the identity of
+// timestamp failedTS failed. The failed identity is gossiped as left,
+// so that the members yet to declare it failed drop it, and a heal does
+// not bring it back. Return true if this node rejoined
+func readmit(failedTS uint64, by string) bool {
+	// A join or leave in progress settles the identity itself
+	if !controlMutex.TryLock() {
+		return false
+	}
+	defer controlMutex.Unlock()
+	if !isJoined() || isLeaving() || getCurrentMember().TimeStamp != failedTS {
+		return false
+	}
+	failed := *getCurrentMember()
+	timestamp := uint64(time.Now().UnixNano())
+	if timestamp <= failed.TimeStamp {
+		timestamp = failed.TimeStamp + 1
 	}
+	self := Member{timestamp, failed.IP, failed.State &^ StateSuspect, failed.Meta}
+	setCurrentMember(&self)
+	CurrentList.MarkDead(failed.TimeStamp, failed.IP, StateDead)
+	// The list keeps its own copy
+	member := self
+	CurrentList.Insert(&member)
+
+	Readmissions.Inc()
+	Logger.Warn("Declared failed by the group, rejoin with a new identity", F("member", by), F("ts", failed.TimeStamp), F("new_ts", timestamp))
+	addUpdate2Cache(&failed, MemUpdateLeave)
+	addUpdate2Cache(&self, MemUpdateJoin)
+	return true
 }
 
-func initiateLeave() {
-	uid := TTLCaches.RandGen.Uint64()
-	update := Update{uid, TTL_, MemUpdateLeave, CurrentMember.TimeStamp, CurrentMember.IP, CurrentMember.State}
-	// Clear current ttl cache and add delete update to the cache
-	TTLCaches = NewTtlCache()
+// Voluntarily leave the group
+// The leave update is sent directly to every member and kept in the TTL
+// cache to be piggybacked, until a majority of the members acked it or
+// timeout elapses. Return whether the leave was confirmed. Afterwards
+// the daemon stops probing and responding.
+func Leave(timeout time.Duration) bool {
+	controlMutex.Lock()
+	if isLeaving() {
+		controlMutex.Unlock()
+		return false
+	}
+	uid := TTLCaches.NewID()
+	self := getCurrentMember()
+	update := Update{uid, TTL_, MemUpdateLeave, self.TimeStamp, self.IP, self.State, nil}
+	// Clear current ttl cache and add leave update to the cache
+	TTLCaches.Reset()
 	TTLCaches.Set(&update)
 	isUpdateDuplicate(uid)
-	Logger.Info("Member (%d, %s) leaves", CurrentMember.TimeStamp, LocalIP)
-	time.Sleep(LeaveDelayPeriod)
+	Logger.Info("Leave", F("member", LocalIP), F("ts", self.TimeStamp), F("update_id", uid))
+
+	var updateBuffer bytes.Buffer
+	writeUpdate(&updateBuffer, &update)
+
+	// Everyone except self is a broadcast target
+	members := CurrentList.Snapshot()
+	targets := make([]*Member, 0, len(members))
+	for i := range members {
+		member := &members[i]
+		if isCurrentMember(member.TimeStamp, member.IP) {
+			continue
+		}
+		targets = append(targets, member)
+	}
+	quorum := len(targets)/2 + 1
+	if len(targets) == 0 {
+		quorum = 0
+	}
+
+	leaveMutex.Lock()
+	leaveSeqs = make(map[uint16]uint32)
+	leaveAcked = make(map[uint32]bool)
+	leaveAcks = make(chan uint32, len(targets))
+	acks := leaveAcks
+	leaveMutex.Unlock()
+	// Other control calls go on while waiting for the acks, a join,
+	// leave or readmission finds the leave in progress
+	controlMutex.Unlock()
+
+	acked := make(map[uint32]bool)
+	broadcast := func() {
+		for _, member := range targets {
+			if acked[member.IP] {
+				continue
+			}
+			seq := pingWithPayload(member, updateBuffer.Bytes(), MemUpdateLeave)
+			leaveMutex.Lock()
+			leaveSeqs[seq] = member.IP
+			leaveMutex.Unlock()
+		}
+	}
+
+	// Rebroadcast to the members which have not acked yet every ping timeout
+	broadcast()
+	deadline := time.NewTimer(timeout)
+	retry := time.NewTicker(PingTimeoutPeriod)
+wait:
+	for len(acked) < quorum {
+		select {
+		case ip := <-acks:
+			acked[ip] = true
+		case <-retry.C:
+			broadcast()
+		case <-deadline.C:
+			Logger.Warn("Leave timeout", F("acked", len(acked)), F("members", len(targets)))
+			break wait
+		}
+	}
+	deadline.Stop()
+	retry.Stop()
+	confirmed := len(acked) >= quorum
+
+	controlMutex.Lock()
+	defer controlMutex.Unlock()
+	leaveMutex.Lock()
+	leaveSeqs = nil
+	leaveAcked = nil
+	leaveAcks = nil
+	leaveMutex.Unlock()
+
+	if confirmed {
+		Logger.Info("Leave confirmed", F("acked", len(acked)), F("members", len(targets)))
+	}
+
+	// Stop probing and responding
+	CurrentList.MarkDead(self.TimeStamp, self.IP, StateLeft)
+	setJoined(false)
+	timerMutex.Lock()
+	for _, timer := range PingAckTimeout {
+		timer.Stop()
+	}
+	timerMutex.Unlock()
 	initilize()
+	return confirmed
+}
+
+// Return true while Leave broadcasts the leave update
+func isLeaving() bool {
+	leaveMutex.Lock()
+	defer leaveMutex.Unlock()
+	return leaveSeqs != nil
+}
+
+// Report an ack of a leave broadcast ping, if the leave is in progress
+// Each member is reported once
+func handleLeaveAck(seq uint16) {
+	leaveMutex.Lock()
+	defer leaveMutex.Unlock()
+	ip, ok := leaveSeqs[seq]
+	if ok {
+		delete(leaveSeqs, seq)
+		if !leaveAcked[ip] {
+			leaveAcked[ip] = true
+			leaveAcks <- ip
+		}
+	}
 }
 
 func periodicPingIntroducer() {
 	for {
-		global_wg.Wait() // Once leave, Do not execute this function
 		// Periodiclly ping introducer when introducer is failed.
 		// Piggyback it's self member info
 		// Use for introducer revive
-		if (CurrentList.Size() > 0) && (!CurrentList.ContainsIP(ip2int(net.ParseIP(IntroducerIP)))) && (LocalIP != IntroducerIP) {
+		// Once leave, Do not execute this function
+		if isJoined() && (CurrentList.Size() > 0) && (!CurrentList.ContainsIP(ip2int(net.ParseIP(IntroducerIP)))) && (LocalIP != IntroducerIP) {
 			// Construct a join update
-			uid := TTLCaches.RandGen.Uint64()
-			update := Update{uid, TTL_, MemUpdateJoin, CurrentMember.TimeStamp, CurrentMember.IP, CurrentMember.State}
+			uid := TTLCaches.NewID()
+			self := getCurrentMember()
+			update := Update{uid, TTL_, MemUpdateJoin, self.TimeStamp, self.IP, self.State, encodeMetadata(self.Meta)}
 			isUpdateDuplicate(uid)
 			// Construct a buffer to carry binary update struct
 			var updateBuffer bytes.Buffer
-			binary.Write(&updateBuffer, binary.BigEndian, &update)
+			writeUpdate(&updateBuffer, &update)
 			// Send piggyback Join Update
-			Logger.Info("Introducer failed, try to ping introducer\n")
-			pingWithPayload(&Member{0, ip2int(net.ParseIP(IntroducerIP)), 0}, updateBuffer.Bytes(), MemUpdateJoin)
+			Logger.Info("Introducer failed, try to ping introducer", F("member", IntroducerIP))
+			pingWithPayload(&Member{0, ip2int(net.ParseIP(IntroducerIP)), 0, nil}, updateBuffer.Bytes(), MemUpdateJoin)
 		}
 
 		// Ping introducer period
-		time.Sleep(PingIntroPeriod)
+		if !sleepDaemon(PingIntroPeriod) {
+			return
+		}
 	}
 }
 
-// Periodically ping a randomly selected target
+// Periodically ping randomly selected targets, Conf.ProbeFanout of them
+// every probe interval
 func periodicPing() {
 	for {
-		// Shuffle membership list and get a member
+		interval := updateProbeInterval()
+		// Shuffle membership list and get distinct members
 		// Only executed when the membership list is not empty
-		if CurrentList.Size() > 0 {
+		probed := make(map[[2]uint64]bool)
+		for i := CurrentList.Size(); i > 0 && len(probed) < probeFanout(); i-- {
 			member := CurrentList.Shuffle()
 			// Do not pick itself as the ping target
-			if (member.TimeStamp == CurrentMember.TimeStamp) && (member.IP == CurrentMember.IP) {
-				time.Sleep(PingSendingPeriod)
+			if member == nil || isCurrentMember(member.TimeStamp, member.IP) {
 				continue
 			}
-			Logger.Info("Member (%d, %d) is selected by shuffling\n", member.TimeStamp, member.IP)
+			key := [2]uint64{member.TimeStamp, uint64(member.IP)}
+			if probed[key] {
+				continue
+			}
+			probed[key] = true
+			Logger.Debug("Member selected by shuffling", F("member", int2ip(member.IP).String()), F("ts", member.TimeStamp))
 			// Get update entry from TTL Cache
 			update, flag, err := getUpdate()
 			// if no update there, do pure ping
@@ -246,20 +948,52 @@ func periodicPing() {
 				pingWithPayload(member, update, flag)
 			}
 		}
-		time.Sleep(PingSendingPeriod)
+		if !sleepDaemon(interval) {
+			return
+		}
 	}
 }
 
 func udpDaemonHandle(connect *net.UDPConn) {
+	var mismatchWarned time.Time
 	for {
-		global_wg.Wait() // Once leave, stop receiving messages
 		// Making a buffer to accept the grep command content from client
-		buffer := make([]byte, 1024)
+		buffer := make([]byte, PacketBufferSize)
 		n, addr, err := connect.ReadFromUDP(buffer)
-		printError(err)
-
+		if err != nil {
+			// The socket is closed on shutdown
+			if daemonCtx.Err() != nil {
+				return
+			}
+			printError(err)
+			continue
+		}
+		// Once leave, stop responding messages
+		if !isJoined() {
+			continue
+		}
 		// Seperate header and payload
-		const HeaderLength = 4 // Header Length 4 bytes
+		// A mixed cluster cannot parse each other's packets
+		if n > 0 && buffer[0] != WireVersion {
+			PacketsMismatched.Inc()
+			if now := time.Now(); now.Sub(mismatchWarned) > ThrottleLogPeriod {
+				mismatchWarned = now
+				Logger.Warn("Drop packets of another wire version, restart the whole group on upgrade", F("member", addr.IP.String()), F("version", buffer[0]), F("want", WireVersion))
+			}
+			continue
+		}
+		const HeaderLength = 5 // Header Length 5 bytes
+		if n < HeaderLength {
+			PacketsMalformed.Inc()
+			Logger.Debug("Drop packet shorter than a header", F("member", addr.IP.String()), F("size", n))
+			continue
+		}
+		PacketsReceived.With(messageType(buffer[1])).Inc()
+		BytesReceived.With(messageType(buffer[1])).Add(uint64(n))
+		// A flooding member does not get acks and updates computed for it
+		if !allowRecv(addr.IP.String(), n) {
+			continue
+		}
 
 		// Read header
 		headerBinData := buffer[:HeaderLength]
@@ -273,26 +1007,48 @@ func udpDaemonHandle(connect *net.UDPConn) {
 
 		// Resume detection
 
-		if header.Type&Ping != 0 {
+		if header.Type&(Ping|Ack) == Ping|Ack {
+			// Direct message, neither a ping nor an ack
+			Logger.Debug("Receive direct message", F("member", addr.IP.String()), F("kind", header.Reserved))
+			handleDirect(header.Reserved, payload)
+
+		} else if header.Type&Ping != 0 {
 
 			reserved := uint8(0x00)
 			// Check whether this ping's source IP is within the memberlist
-			// IF not, set reserved 0xff, ask for sender's join update
+			// IF not, set AckUnknownSender, ask for sender's join update
 			// init request will not participate this procedure
 			// Because every new join member is unknown to the introducer
 			if (!CurrentList.ContainsIP(ip2int(addr.IP))) && (header.Type&MemInitRequest == 0) {
-				reserved = 0xff
-				Logger.Info("Receive ping from unknown member, set reserved field 0xff")
+				reserved = AckUnknownSender
+				Logger.Info("Receive ping from unknown member, set AckUnknownSender", F("member", addr.IP.String()), F("seq", header.Seq))
+				// The sender was declared failed, tell it which identity
+				if _, failed := CurrentList.FailedTimeStamp(ip2int(addr.IP)); failed {
+					reserved |= AckFailedSender
+				}
 			}
 
 			// Check whether this ping carries Init Request
 			if header.Type&MemInitRequest != 0 {
 				// Handle Init Request
-				Logger.Info("Receive Init Request from %s: with seq %d\n", addr.IP.String(), header.Seq)
+				Logger.Info("Receive init request", F("member", addr.IP.String()), F("seq", header.Seq))
 				initReply(addr.IP.String(), header.Seq, payload)
 
+			} else if header.Type&MemUpdateExt == MemUpdateExt {
+				Logger.Debug("Handle update", F("from", addr.IP.String()), F("seq", header.Seq), F("type", "extended"))
+				handleExtUpdate(payload)
+				// Get update entry from TTL Cache
+				update, flag, err := getUpdate()
+				// if no update there, do pure ping
+				if err != nil {
+					ack(addr.IP.String(), header.Seq, reserved)
+				} else {
+					// Send update as payload of ping
+					ackWithPayload(addr.IP.String(), header.Seq, update, flag, reserved)
+				}
+
 			} else if header.Type&MemUpdateSuspect != 0 {
-				Logger.Info("Handle suspect update sent from %s\n", addr.IP.String())
+				Logger.Debug("Handle update", F("from", addr.IP.String()), F("seq", header.Seq), F("type", "suspect"))
 				handleSuspect(payload)
 				// Get update entry from TTL Cache
 				update, flag, err := getUpdate()
@@ -305,7 +1061,7 @@ func udpDaemonHandle(connect *net.UDPConn) {
 				}
 
 			} else if header.Type&MemUpdateResume != 0 {
-				Logger.Info("Handle resume update sent from %s\n", addr.IP.String())
+				Logger.Debug("Handle update", F("from", addr.IP.String()), F("seq", header.Seq), F("type", "resume"))
 				handleResume(payload)
 				// Get update entry from TTL Cache
 				update, flag, err := getUpdate()
@@ -318,7 +1074,7 @@ func udpDaemonHandle(connect *net.UDPConn) {
 				}
 
 			} else if header.Type&MemUpdateLeave != 0 {
-				Logger.Info("Handle leave update sent from %s\n", addr.IP.String())
+				Logger.Debug("Handle update", F("from", addr.IP.String()), F("seq", header.Seq), F("type", "leave"))
 				handleLeave(payload)
 				// Get update entry from TTL Cache
 				update, flag, err := getUpdate()
@@ -331,7 +1087,7 @@ func udpDaemonHandle(connect *net.UDPConn) {
 				}
 
 			} else if header.Type&MemUpdateJoin != 0 {
-				Logger.Info("Handle join update sent from %s\n", addr.IP.String())
+				Logger.Debug("Handle update", F("from", addr.IP.String()), F("seq", header.Seq), F("type", "join"))
 				handleJoin(payload)
 				// Get update entry from TTL Cache
 				update, flag, err := getUpdate()
@@ -354,53 +1110,94 @@ func udpDaemonHandle(connect *net.UDPConn) {
 		} else if header.Type&Ack != 0 {
 
 			// Receive Ack, stop ping timer
+			var rtt time.Duration
+			timerMutex.Lock()
 			timer, ok := PingAckTimeout[header.Seq-1]
 			if ok {
 				timer.Stop()
-				Logger.Info("Receive ACK from [%s] with seq %d\n", addr.IP.String(), header.Seq)
+				Logger.Debug("Receive ack", F("member", addr.IP.String()), F("seq", header.Seq))
 				delete(PingAckTimeout, header.Seq-1)
+				AcksReceived.Inc()
+				rtt = time.Since(PingSentAt[header.Seq-1])
+				ProbeRTT.Observe(rtt.Seconds())
+			}
+			delete(PingSentAt, header.Seq-1)
+			timerMutex.Unlock()
+			handleLeaveAck(header.Seq - 1)
+
+			// The coordinate of the acker comes first, it moves ours
+			// by the RTT of the ping
+			if header.Reserved&AckCoordinate != 0 {
+				reader := bytes.NewReader(payload)
+				coord, err := readCoordinate(reader)
+				if err != nil {
+					printError(err)
+					continue
+				}
+				payload = payload[len(payload)-reader.Len():]
+				if rtt > 0 {
+					Coordinates.Update(addr.IP.String(), coord, rtt)
+				}
+			}
+
+			// If AckFailedSender is set, the acker declared this handler failed,
+			// the timestamp of the failed identity follows the coordinate.
+			// Rejoin with a new identity if it is the current one
+			readmitted := false
+			if header.Reserved&AckFailedSender != 0 {
+				var failedTS uint64
+				if err := binary.Read(bytes.NewReader(payload), binary.BigEndian, &failedTS); err != nil {
+					printError(err)
+					continue
+				}
+				payload = payload[8:]
+				readmitted = readmit(failedTS, addr.IP.String())
 			}
 
 			// Check header's reserved field
-			// If reserved field is 0xff, means this handler is missing in someone else's memberlist,
+			// If AckUnknownSender is set, means this handler is missing in someone else's memberlist,
 			// Hence disseminate join update
-			if header.Reserved == 0xff {
-				uid := TTLCaches.RandGen.Uint64()
-				update := Update{uid, TTL_, MemUpdateJoin, CurrentMember.TimeStamp, CurrentMember.IP, CurrentMember.State}
+			if header.Reserved&AckUnknownSender != 0 && !readmitted {
+				uid := TTLCaches.NewID()
+				self := getCurrentMember()
+				update := Update{uid, TTL_, MemUpdateJoin, self.TimeStamp, self.IP, self.State, encodeMetadata(self.Meta)}
 				TTLCaches.Set(&update)
 				isUpdateDuplicate(uid)
-				Logger.Info("Receive header with reserved 0xff, disseminate join update")
+				Logger.Info("Receive ack with AckUnknownSender, disseminate join update", F("member", addr.IP.String()), F("update_id", uid))
 			}
 
-			// Read payload
-			payload := buffer[HeaderLength:n]
-
 			if header.Type&MemInitReply != 0 {
 				// Ack carries Init Reply, stop init timer
-				stop := init_timer.Stop()
+				timerMutex.Lock()
+				stop := init_timer != nil && init_timer.Stop()
+				timerMutex.Unlock()
 				if stop {
-					Logger.Info("Receive Init Reply from [%s] with %d\n", addr.IP.String(), header.Seq)
+					Logger.Info("Receive init reply", F("member", addr.IP.String()), F("seq", header.Seq))
 				}
 				handleInitReply(payload)
 
+			} else if header.Type&MemUpdateExt == MemUpdateExt {
+				Logger.Debug("Handle update", F("from", addr.IP.String()), F("seq", header.Seq), F("type", "extended"))
+				handleExtUpdate(payload)
+
 			} else if header.Type&MemUpdateSuspect != 0 {
-				Logger.Info("Handle suspect update sent from %s\n", addr.IP.String())
+				Logger.Debug("Handle update", F("from", addr.IP.String()), F("seq", header.Seq), F("type", "suspect"))
 				handleSuspect(payload)
 
 			} else if header.Type&MemUpdateResume != 0 {
-				Logger.Info("Handle resume update sent from %s\n", addr.IP.String())
+				Logger.Debug("Handle update", F("from", addr.IP.String()), F("seq", header.Seq), F("type", "resume"))
 				handleResume(payload)
 
 			} else if header.Type&MemUpdateLeave != 0 {
-				Logger.Info("Handle leave update sent from %s\n", addr.IP.String())
+				Logger.Debug("Handle update", F("from", addr.IP.String()), F("seq", header.Seq), F("type", "leave"))
 				handleLeave(payload)
 
 			} else if header.Type&MemUpdateJoin != 0 {
-				Logger.Info("Handle join update sent from %s\n", addr.IP.String())
+				Logger.Debug("Handle update", F("from", addr.IP.String()), F("seq", header.Seq), F("type", "join"))
 				handleJoin(payload)
 
 			} else {
-				Logger.Info("Receive pure ack sent from %s\n", addr.IP.String())
+				Logger.Debug("Receive pure ack", F("member", addr.IP.String()), F("seq", header.Seq))
 			}
 		}
 	}
@@ -413,16 +1210,16 @@ func isUpdateDuplicate(id uint64) bool {
 	_, ok := DuplicateUpdateCaches[id]
 	mutex.Unlock()
 	if ok {
-		Logger.Info("Receive duplicated update %d\n", id)
+		Logger.Debug("Receive duplicated update", F("update_id", id))
+		DuplicateUpdates.Inc()
 		return true
 	} else {
 		mutex.Lock()
 		DuplicateUpdateCaches[id] = 1 // add to cache
 		mutex.Unlock()
-		Logger.Info("Add update %d to duplicated cache table \n", id)
-		recent_update_timer := time.NewTimer(UpdateDeletePeriod) // set a delete timer
-		go func() {
-			<-recent_update_timer.C
+		Logger.Debug("Add update to duplicated cache table", F("update_id", id))
+		// set a delete timer
+		afterTimer(UpdateDeletePeriod, func() {
 			mutex.Lock()
 			_, ok := DuplicateUpdateCaches[id]
 			mutex.Unlock()
@@ -430,9 +1227,9 @@ func isUpdateDuplicate(id uint64) bool {
 				mutex.Lock()
 				delete(DuplicateUpdateCaches, id) // delete from cache
 				mutex.Unlock()
-				Logger.Info("Delete update %d from duplicated cache table \n", id)
+				Logger.Debug("Delete update from duplicated cache table", F("update_id", id))
 			}
-		}()
+		})
 		return false
 	}
 }
@@ -445,108 +1242,182 @@ func getUpdate() ([]byte, uint8, error) {
 		return binBuffer.Bytes(), 0, err
 	}
 
-	binary.Write(&binBuffer, binary.BigEndian, update)
-	return binBuffer.Bytes(), update.UpdateType, nil
+	writeUpdate(&binBuffer, update)
+	// Extended updates share the MemUpdateExt header flag
+	return binBuffer.Bytes(), update.UpdateType & 0xf0, nil
 }
 
 func handleSuspect(payload []byte) {
-	buf := bytes.NewReader(payload)
-	var update Update
-	err := binary.Read(buf, binary.BigEndian, &update)
-	printError(err)
+	update, err := readUpdate(payload)
+	if err != nil {
+		printError(err)
+		return
+	}
 
 	// Retrieve update ID
 	updateID := update.UpdateID
 	if !isUpdateDuplicate(updateID) {
 		// If find someone sends suspect update which
 		// suspect self, tell them I am alvie
-		if CurrentMember.TimeStamp == update.MemberTimeStamp && CurrentMember.IP == update.MemberIP {
-			addUpdate2Cache(CurrentMember, MemUpdateResume)
+		if isCurrentMember(update.MemberTimeStamp, update.MemberIP) {
+			addUpdate2Cache(getCurrentMember(), MemUpdateResume)
+			SuspicionsRefuted.Inc()
+			return
+		}
+		// Dead or left member can not be suspected again
+		if CurrentList.IsTombstoned(update.MemberTimeStamp, update.MemberIP) {
+			Logger.Info("Ignore update of tombstoned member", F("member", int2ip(update.MemberIP).String()), F("ts", update.MemberTimeStamp), F("update_id", update.UpdateID), F("type", "suspect"))
 			return
 		}
 		// Receive new update, handle it
 		CurrentList.Update(update.MemberTimeStamp, update.MemberIP, update.MemberState)
 		TTLCaches.Set(&update)
-		failure_timer := time.NewTimer(SuspectPeriod)
-		FailureTimeout[[2]uint64{update.MemberTimeStamp, uint64(update.MemberIP)}] = failure_timer
-		go func() {
-			<-failure_timer.C
-			Logger.Info("[Failure Detected](%s, %d) Failed, detected by others\n", int2ip(update.MemberIP).String(), update.MemberTimeStamp)
-			err := CurrentList.Delete(update.MemberTimeStamp, update.MemberIP)
+		timerMutex.Lock()
+		FailureTimeout[[2]uint64{update.MemberTimeStamp, uint64(update.MemberIP)}] = afterTimer(SuspectPeriod, func() {
+			Logger.Info("Failure detected", F("member", int2ip(update.MemberIP).String()), F("ts", update.MemberTimeStamp), F("by", "others"))
+			err := CurrentList.MarkDead(update.MemberTimeStamp, update.MemberIP, StateDead)
 			printError(err)
+			if err == nil {
+				FailuresDetected.With("others").Inc()
+			}
+			timerMutex.Lock()
 			delete(FailureTimeout, [2]uint64{update.MemberTimeStamp, uint64(update.MemberIP)})
-		}()
+			timerMutex.Unlock()
+		})
+		timerMutex.Unlock()
 
 	}
 }
 
 func handleResume(payload []byte) {
-	buf := bytes.NewReader(payload)
-	var update Update
-	err := binary.Read(buf, binary.BigEndian, &update)
-	printError(err)
+	update, err := readUpdate(payload)
+	if err != nil {
+		printError(err)
+		return
+	}
 
 	// Retrieve update ID
 	updateID := update.UpdateID
 	if !isUpdateDuplicate(updateID) {
+		// Dead or left member can not be resumed
+		if CurrentList.IsTombstoned(update.MemberTimeStamp, update.MemberIP) {
+			Logger.Info("Ignore update of tombstoned member", F("member", int2ip(update.MemberIP).String()), F("ts", update.MemberTimeStamp), F("update_id", update.UpdateID), F("type", "resume"))
+			return
+		}
 		// Receive new update, handle it
+		timerMutex.Lock()
 		timer, ok := FailureTimeout[[2]uint64{update.MemberTimeStamp, uint64(update.MemberIP)}]
 		if ok {
 			timer.Stop()
 			delete(FailureTimeout, [2]uint64{update.MemberTimeStamp, uint64(update.MemberIP)})
+			SuspicionsRefuted.Inc()
 		}
+		timerMutex.Unlock()
 		err := CurrentList.Update(update.MemberTimeStamp, update.MemberIP, update.MemberState)
 		// If the resume target is not in the list, insert it to the list
 		if err != nil {
-			CurrentList.Insert(&Member{update.MemberTimeStamp, update.MemberIP, update.MemberState})
+			CurrentList.Insert(&Member{update.MemberTimeStamp, update.MemberIP, update.MemberState, nil})
 		}
 		TTLCaches.Set(&update)
 	}
 }
 
 func handleLeave(payload []byte) {
-	buf := bytes.NewReader(payload)
-	var update Update
-	err := binary.Read(buf, binary.BigEndian, &update)
-	printError(err)
+	update, err := readUpdate(payload)
+	if err != nil {
+		printError(err)
+		return
+	}
 
 	// Retrieve update ID
 	updateID := update.UpdateID
 	if !isUpdateDuplicate(updateID) {
+		// A forced or stale leave of self, tell them I am alive.
+		// During my own leave it is the echo of my update
+		if isCurrentMember(update.MemberTimeStamp, update.MemberIP) {
+			if !isLeaving() {
+				addUpdate2Cache(getCurrentMember(), MemUpdateResume)
+				SuspicionsRefuted.Inc()
+			}
+			return
+		}
 		// Receive new update, handle it
-		CurrentList.Delete(update.MemberTimeStamp, update.MemberIP)
+		CurrentList.MarkDead(update.MemberTimeStamp, update.MemberIP, StateLeft)
 		TTLCaches.Set(&update)
 	}
 }
 
 func handleJoin(payload []byte) {
-	buf := bytes.NewReader(payload)
-	var update Update
-	err := binary.Read(buf, binary.BigEndian, &update)
-	printError(err)
+	update, err := readUpdate(payload)
+	if err != nil {
+		printError(err)
+		return
+	}
 
 	// Retrieve update ID
 	updateID := update.UpdateID
 	if !isUpdateDuplicate(updateID) {
+		// Dead or left member can not join again with the same identity
+		if CurrentList.IsTombstoned(update.MemberTimeStamp, update.MemberIP) {
+			Logger.Info("Ignore update of tombstoned member", F("member", int2ip(update.MemberIP).String()), F("ts", update.MemberTimeStamp), F("update_id", update.UpdateID), F("type", "join"))
+			return
+		}
+		meta, err := readMetadata(bytes.NewReader(update.Payload))
+		printError(err)
 		// Receive new update, handle it
-		CurrentList.Insert(&Member{update.MemberTimeStamp, update.MemberIP,
-			update.MemberState})
+		err = CurrentList.Insert(&Member{update.MemberTimeStamp, update.MemberIP,
+			update.MemberState, meta})
+		if err != nil {
+			// Known member, the join may carry newer tags
+			CurrentList.SetMetadata(update.MemberTimeStamp, update.MemberIP, meta)
+		}
 		TTLCaches.Set(&update)
 		// Introducer diseeminate its info when receives join
 		if LocalIP == IntroducerIP {
-			uid := TTLCaches.RandGen.Uint64()
-			reply_update := Update{uid, TTL_, MemUpdateJoin, CurrentMember.TimeStamp, CurrentMember.IP, CurrentMember.State}
+			uid := TTLCaches.NewID()
+			self := getCurrentMember()
+			reply_update := Update{uid, TTL_, MemUpdateJoin, self.TimeStamp, self.IP, self.State, encodeMetadata(self.Meta)}
 			TTLCaches.Set(&reply_update)
 			isUpdateDuplicate(uid)
-			Logger.Info("Introducer set its info update to the cache\n")
+			Logger.Debug("Introducer set its info update to the cache", F("update_id", uid))
+		}
+	}
+}
+
+// Handle an update sent with the MemUpdateExt flag, by its type
+// Updates of unknown types are forwarded untouched
+func handleExtUpdate(payload []byte) {
+	update, err := readUpdate(payload)
+	if err != nil {
+		printError(err)
+		return
+	}
+	if !isUpdateDuplicate(update.UpdateID) {
+		switch update.UpdateType {
+		case MemUpdateMeta:
+			handleMeta(&update)
+		case MemUpdateUserEvent:
+			handleUserEvent(&update)
+		case MemUpdateQuery:
+			handleQuery(&update)
+		case MemUpdateHeal:
+			handleHeal(&update)
+		case MemUpdateHealth:
+			handleHealth(&update)
+		default:
+			Logger.Debug("Forward update of unknown type", F("update_id", update.UpdateID), F("type", update.UpdateType))
 		}
+		TTLCaches.Set(&update)
 	}
 }
 
 // Generate a new update and set it in TTL Cache
 func addUpdate2Cache(member *Member, updateType uint8) {
-	uid := TTLCaches.RandGen.Uint64()
-	update := Update{uid, TTL_, updateType, member.TimeStamp, member.IP, member.State}
+	uid := TTLCaches.NewID()
+	update := Update{uid, TTL_, updateType, member.TimeStamp, member.IP, member.State, nil}
+	if updateType == MemUpdateJoin || updateType == MemUpdateMeta || updateType == MemUpdateHeal {
+		update.Payload = encodeMetadata(member.Meta)
+	}
 	TTLCaches.Set(&update)
 	// This daemon is the update producer, add this update to the update duplicate cache
 	isUpdateDuplicate(uid)
@@ -554,67 +1425,86 @@ func addUpdate2Cache(member *Member, updateType uint8) {
 
 // Handle the full membership list(InitReply) received from introducer
 func handleInitReply(payload []byte) {
-	num := len(payload) / 13 // 13 bytes per member
 	buf := bytes.NewReader(payload)
-	for idx := 0; idx < num; idx++ {
-		var member Member
-		err := binary.Read(buf, binary.BigEndian, &member)
-		printError(err)
+	for buf.Len() > 0 {
+		member, err := readMember(buf)
+		if err != nil {
+			printError(err)
+			return
+		}
+		if CurrentList.IsTombstoned(member.TimeStamp, member.IP) {
+			continue
+		}
 		// Insert existing member to the new member's list
 		CurrentList.Insert(&member)
 	}
+	// The list is complete, forget the members which died meanwhile
+	if CurrentSnapshot != nil {
+		CurrentSnapshot.reset(CurrentList.Snapshot())
+	}
 }
 
 // Introducer replies new node join init request and
 // send the new node join updates to others in membership
 func initReply(addr string, seq uint16, payload []byte) {
 	// Read and insert new member to the memberlist
-	var member Member
-	buf := bytes.NewReader(payload)
-	err := binary.Read(buf, binary.BigEndian, &member)
-	printError(err)
+	member, err := readMember(bytes.NewReader(payload))
+	if err != nil {
+		printError(err)
+		return
+	}
 	// Update state of the new member
 	// ...
 	CurrentList.Insert(&member)
 	addUpdate2Cache(&member, MemUpdateJoin)
 
 	// Put the entire memberlist to the Init Reply's payload
-	var memBuffer bytes.Buffer // Temp buf to store member's binary value
 	var binBuffer bytes.Buffer
 
-	for i := 0; i < CurrentList.Size(); i += 1 {
-		member_, _ := CurrentList.RetrieveByIdx(i)
-
-		binary.Write(&memBuffer, binary.BigEndian, member_)
-		binBuffer.Write(memBuffer.Bytes())
-		memBuffer.Reset() // Clear buffer
+	for _, member_ := range CurrentList.Snapshot() {
+		writeMember(&binBuffer, &member_)
 	}
 
 	// Send pigggback Init Reply
 	ackWithPayload(addr, seq, binBuffer.Bytes(), MemInitReply, 0x00)
 }
 
-func initRequest(member *Member) {
+// Send the Init Request to the first contact, and to the next one
+// whenever the previous does not reply in time
+func initRequest(member *Member, contacts []string) {
 	// Construct Init Request payload
 	var binBuffer bytes.Buffer
-	binary.Write(&binBuffer, binary.BigEndian, member)
+	writeMember(&binBuffer, member)
 
 	// Send piggyback Init Request
-	pingWithPayload(&Member{0, ip2int(net.ParseIP(IntroducerIP)), 0}, binBuffer.Bytes(), MemInitRequest)
-
-	// Start Init timer, if expires, exit process
-	init_timer = time.NewTimer(InitTimeoutPeriod)
-	go func() {
-		<-init_timer.C
-		Logger.Info("Init %s timeout, process exit\n", IntroducerIP)
-		os.Exit(1)
-	}()
+	contact := contacts[0]
+	pingWithPayload(&Member{0, ip2int(net.ParseIP(contact)), 0, nil}, binBuffer.Bytes(), MemInitRequest)
+
+	// Start Init timer, if expires with no contact left, exit process
+	timer := afterTimer(InitTimeoutPeriod, func() {
+		if len(contacts) > 1 && isJoined() {
+			Logger.Warn("Init timeout, try next member", F("member", contact), F("next", contacts[1]))
+			initRequest(member, contacts[1:])
+			return
+		}
+		Logger.Error("Init timeout, process exit", F("member", contact))
+		initFailed <- struct{}{}
+	})
+	timerMutex.Lock()
+	init_timer = timer
+	timerMutex.Unlock()
 }
 
 func ackWithPayload(addr string, seq uint16, payload []byte, flag uint8, reserved uint8) {
-	packet := Header{Ack | flag, seq + 1, reserved}
+	packet := Header{WireVersion, Ack | flag, seq + 1, reserved | AckCoordinate}
 	var binBuffer bytes.Buffer
 	binary.Write(&binBuffer, binary.BigEndian, packet)
+	writeCoordinate(&binBuffer, Coordinates.Get())
+	if reserved&AckFailedSender != 0 {
+		// 0 if the sender joined again meanwhile
+		failedTS, _ := CurrentList.FailedTimeStamp(ip2int(net.ParseIP(addr)))
+		binary.Write(&binBuffer, binary.BigEndian, failedTS)
+	}
 
 	if payload != nil {
 		binBuffer.Write(payload) // Append payload
@@ -628,46 +1518,91 @@ func ack(addr string, seq uint16, reserved uint8) {
 	ackWithPayload(addr, seq, nil, 0x00, reserved)
 }
 
-func pingWithPayload(member *Member, payload []byte, flag uint8) {
-	// Source for genearting random number
-	randSource := rand.NewSource(time.Now().UnixNano())
-	randGen := rand.New(randSource)
-	seq := randGen.Intn(0x01<<15 - 2)
+// Send a ping to member and start its ack timer, return the ping seq
+func pingWithPayload(member *Member, payload []byte, flag uint8) uint16 {
+	seq := int(atomic.AddUint32(&pingSeq, 1) % (0x01<<15 - 2))
 	addr := int2ip(member.IP).String() + Port
 
-	packet := Header{Ping | flag, uint16(seq), 0}
+	packet := Header{WireVersion, Ping | flag, uint16(seq), 0}
 	var binBuffer bytes.Buffer
 	binary.Write(&binBuffer, binary.BigEndian, packet)
 
-	if payload != nil {
-		binBuffer.Write(payload) // Append payload
-		udpSend(addr, binBuffer.Bytes())
-	} else {
-		udpSend(addr, binBuffer.Bytes())
+	// With the TCP fallback, a TCP probe runs alongside the ping and
+	// only matters if the ping times out
+	var tcpAcked chan bool
+	if Conf.TCPFallback {
+		tcpAcked = make(chan bool, 1)
 	}
-	Logger.Info("Ping (%s, %d)\n", addr, seq)
 
-	timer := time.NewTimer(PingTimeoutPeriod)
-	PingAckTimeout[uint16(seq)] = timer
-	go func() {
-		<-timer.C
-		Logger.Info("Ping (%s, %d) timeout\n", addr, seq)
-		err := CurrentList.Update(member.TimeStamp, member.IP, StateSuspect)
+	// Register the ack timer before sending, the ack may arrive at once
+	timer := afterTimer(PingTimeoutPeriod, func() {
+		// Leave pings and pings sent before leaving raise no suspicion,
+		// it would be gossiped along the leave update
+		if isLeaving() || !isJoined() {
+			timerMutex.Lock()
+			delete(PingAckTimeout, uint16(seq))
+			delete(PingSentAt, uint16(seq))
+			timerMutex.Unlock()
+			return
+		}
+		Logger.Info("Ping timeout", F("member", int2ip(member.IP).String()), F("seq", seq))
+		ProbeTimeouts.Inc()
+		// A member acking over TCP is alive, only UDP is lost on the way.
+		// A probe yet to finish failed, it has the same timeout
+		acked := false
+		select {
+		case acked = <-tcpAcked:
+		default:
+		}
+		if acked {
+			UDPBlocked.Inc()
+			Logger.Warn("UDP appears blocked, member acked a TCP probe", F("member", int2ip(member.IP).String()), F("seq", seq))
+			timerMutex.Lock()
+			delete(PingAckTimeout, uint16(seq))
+			delete(PingSentAt, uint16(seq))
+			timerMutex.Unlock()
+			return
+		}
+		err := CurrentList.Update(member.TimeStamp, member.IP, StateSuspect|member.State&HealthMask)
 		if err == nil {
 			addUpdate2Cache(member, MemUpdateSuspect)
+			SuspicionsRaised.Inc()
 		}
-		delete(PingAckTimeout, uint16(seq))
 		// Handle local suspect timeout
-		failure_timer := time.NewTimer(SuspectPeriod)
-		FailureTimeout[[2]uint64{member.TimeStamp, uint64(member.IP)}] = failure_timer
-		go func() {
-			<-failure_timer.C
-			Logger.Info("[Failure Detected](%s, %d) Failed, detected by self\n", int2ip(member.IP).String(), member.TimeStamp)
-			err := CurrentList.Delete(member.TimeStamp, member.IP)
+		timerMutex.Lock()
+		delete(PingAckTimeout, uint16(seq))
+		delete(PingSentAt, uint16(seq))
+		FailureTimeout[[2]uint64{member.TimeStamp, uint64(member.IP)}] = afterTimer(SuspectPeriod, func() {
+			Logger.Info("Failure detected", F("member", int2ip(member.IP).String()), F("ts", member.TimeStamp), F("by", "self"))
+			err := CurrentList.MarkDead(member.TimeStamp, member.IP, StateDead)
 			printError(err)
+			if err == nil {
+				FailuresDetected.With("self").Inc()
+			}
+			timerMutex.Lock()
 			delete(FailureTimeout, [2]uint64{member.TimeStamp, uint64(member.IP)})
-		}()
-	}()
+			timerMutex.Unlock()
+		})
+		timerMutex.Unlock()
+	})
+	timerMutex.Lock()
+	PingAckTimeout[uint16(seq)] = timer
+	PingSentAt[uint16(seq)] = time.Now()
+	timerMutex.Unlock()
+	ProbesSent.Inc()
+	if tcpAcked != nil {
+		goDaemon(func() { tcpAcked <- tcpProbe(member, uint16(seq)) })
+	}
+
+	if payload != nil {
+		binBuffer.Write(payload) // Append payload
+		udpSend(addr, binBuffer.Bytes())
+	} else {
+		udpSend(addr, binBuffer.Bytes())
+	}
+	Logger.Debug("Ping", F("member", int2ip(member.IP).String()), F("seq", seq), F("type", messageType(packet.Type)))
+
+	return uint16(seq)
 }
 
 func ping(member *Member) {
@@ -676,27 +1611,66 @@ func ping(member *Member) {
 
 // Start the membership service and join in the group
 func initilize() bool {
-	// Create self entry
-	LocalIP = getLocalIP().String()
-	Logger = NewSsmsLogger(LocalIP)
+	// Create self entry, the IP is read by other goroutines after a leave
+	if LocalIP == "" {
+		LocalIP = getLocalIP().String()
+	}
+	// Tests supply their own Logger
+	if Logger == nil {
+		logger, err := NewSsmsLogger(LocalIP)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		Logger = logger
+	}
 	timestamp := time.Now().UnixNano()
 	state := StateAlive
-	CurrentMember = &Member{uint64(timestamp), ip2int(getLocalIP()), uint8(state)}
+	// Tags and health outlive a leave, the member rejoins with them
+	var meta *Metadata
+	if self := getCurrentMember(); self != nil {
+		meta = self.Meta
+		state |= int(self.State & HealthMask)
+	} else if len(Conf.Tags) > 0 {
+		if err := Conf.Tags.validate(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		meta = &Metadata{uint64(timestamp), Conf.Tags}
+	}
+	setCurrentMember(&Member{uint64(timestamp), ip2int(getLocalIP()), uint8(state), meta})
 
-	// Create member list
-	CurrentList = NewMemberList(20)
+	// Create member list, cleared in place after a leave since
+	// other goroutines hold it
+	if CurrentList == nil {
+		CurrentList = NewMemberList(20)
+	} else {
+		CurrentList.Reset(20)
+	}
 
 	// Make necessary tables
+	timerMutex.Lock()
 	PingAckTimeout = make(map[uint16]*time.Timer)
+	PingSentAt = make(map[uint16]time.Time)
 	FailureTimeout = make(map[[2]uint64]*time.Timer)
+	timerMutex.Unlock()
+	mutex.Lock()
 	DuplicateUpdateCaches = make(map[uint64]uint8)
-	TTLCaches = NewTtlCache()
+	mutex.Unlock()
+	// The cache outlives a leave, other goroutines may hold it
+	if TTLCaches == nil {
+		TTLCaches = NewTtlCache()
+	} else {
+		TTLCaches.Reset()
+	}
 
 	return true
 }
 
 // Main func
 func main() {
+	parseFlags()
+	daemonCtx, daemonCancel = context.WithCancel(context.Background())
 
 	// Init
 	if initilize() == true {
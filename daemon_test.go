@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Logger discarding every line
+type discardLogger struct{}
+
+func (discardLogger) Debug(msg string, fields ...Field) {}
+func (discardLogger) Info(msg string, fields ...Field)  {}
+func (discardLogger) Warn(msg string, fields ...Field)  {}
+func (discardLogger) Error(msg string, fields ...Field) {}
+
+// Reset the daemon state to a joined node ip of timestamp ts, alone in
+// its member list. The daemon goroutines stop with the test
+func setupNode(t *testing.T, ip string, ts uint64) *Member {
+	t.Helper()
+	Logger = discardLogger{}
+	stopNode()
+	daemonCtx, daemonCancel = context.WithCancel(context.Background())
+	t.Cleanup(stopNode)
+	LocalIP = ip
+	CurrentList = NewMemberList(20)
+	TTLCaches = NewTtlCache()
+	mutex.Lock()
+	DuplicateUpdateCaches = make(map[uint64]uint8)
+	mutex.Unlock()
+	timerMutex.Lock()
+	PingAckTimeout = make(map[uint16]*time.Timer)
+	PingSentAt = make(map[uint16]time.Time)
+	FailureTimeout = make(map[[2]uint64]*time.Timer)
+	timerMutex.Unlock()
+	self := Member{ts, testIP(ip), StateAlive, nil}
+	setCurrentMember(&self)
+	member := self
+	CurrentList.Insert(&member)
+	setJoined(true)
+	return &self
+}
+
+// Stop the goroutines and timers of the node set up last
+func stopNode() {
+	if daemonCancel != nil {
+		daemonCancel()
+		daemonWg.Wait()
+	}
+	setJoined(false)
+	timerMutex.Lock()
+	defer timerMutex.Unlock()
+	for _, timer := range PingAckTimeout {
+		timer.Stop()
+	}
+	for _, timer := range FailureTimeout {
+		timer.Stop()
+	}
+}
+
+func testIP(ip string) uint32 {
+	return ip2int(net.ParseIP(ip))
+}
+
+// Drain the TTL cache into the encoded updates it gossips
+func drainUpdates(t *testing.T) map[uint8][]byte {
+	t.Helper()
+	updates := make(map[uint8][]byte)
+	for {
+		update, err := TTLCaches.Get()
+		if err != nil {
+			return updates
+		}
+		var buf bytes.Buffer
+		writeUpdate(&buf, update)
+		updates[update.UpdateType] = buf.Bytes()
+	}
+}
+
+// A node paused for longer than SuspectPeriod is declared failed by its
+// peers, learns it from the ack flag once resumed, and rejoins with a new
+// identity which every peer accepts, whether it declared the node failed
+func TestReadmission(t *testing.T) {
+	const peerIP, pausedIP = "10.0.0.1", "10.0.0.2"
+	const failedTS = uint64(1000)
+
+	// The paused node learns from a peer its identity was declared failed
+	setupNode(t, pausedIP, failedTS)
+	CurrentList.Insert(&Member{500, testIP(peerIP), StateAlive, nil})
+	if readmit(failedTS+1, peerIP) {
+		t.Fatal("readmit of another identity rejoined")
+	}
+	if !readmit(failedTS, peerIP) {
+		t.Fatal("readmit of the current identity did not rejoin")
+	}
+	self := getCurrentMember()
+	if self.TimeStamp <= failedTS || self.IP != testIP(pausedIP) {
+		t.Fatalf("new identity (%d, %d), want a timestamp after %d", self.TimeStamp, self.IP, failedTS)
+	}
+	if readmit(failedTS, peerIP) {
+		t.Fatal("second ack for the failed identity rejoined again")
+	}
+	if CurrentList.Select(failedTS, self.IP) != -1 || CurrentList.Select(self.TimeStamp, self.IP) == -1 {
+		t.Fatal("member list of the paused node still has the failed identity")
+	}
+	updates := drainUpdates(t)
+	if updates[MemUpdateLeave] == nil || updates[MemUpdateJoin] == nil {
+		t.Fatalf("readmit gossiped %d updates, want a leave and a join", len(updates))
+	}
+	newTS := self.TimeStamp
+
+	for _, declared := range []bool{true, false} {
+		// A peer which declared the node failed acks it with the
+		// failed identity, one which did not yet still lists it alive
+		setupNode(t, peerIP, 500)
+		CurrentList.Insert(&Member{failedTS, testIP(pausedIP), StateAlive, nil})
+		if declared {
+			CurrentList.MarkDead(failedTS, testIP(pausedIP), StateDead)
+			if ts, ok := CurrentList.FailedTimeStamp(testIP(pausedIP)); !ok || ts != failedTS {
+				t.Fatalf("FailedTimeStamp = %d, %t, want %d, true", ts, ok, failedTS)
+			}
+		} else if _, ok := CurrentList.FailedTimeStamp(testIP(pausedIP)); ok {
+			t.Fatal("FailedTimeStamp reports a member alive in the list")
+		}
+
+		handleLeave(updates[MemUpdateLeave])
+		handleJoin(updates[MemUpdateJoin])
+		if CurrentList.Select(newTS, testIP(pausedIP)) == -1 {
+			t.Fatalf("declared %t: the join of the new identity was ignored", declared)
+		}
+		if CurrentList.Select(failedTS, testIP(pausedIP)) != -1 {
+			t.Fatalf("declared %t: the failed identity is still listed", declared)
+		}
+		if _, ok := CurrentList.FailedTimeStamp(testIP(pausedIP)); ok {
+			t.Fatalf("declared %t: peer would still flag the readmitted node", declared)
+		}
+
+		// A straggling join or heal of the failed identity stays out
+		handleJoin(encodeTestUpdate(MemUpdateJoin, failedTS, testIP(pausedIP)))
+		if err := CurrentList.Resurrect(&Member{failedTS, testIP(pausedIP), StateAlive, nil}); err == nil {
+			t.Fatalf("declared %t: a heal brought the failed identity back", declared)
+		}
+		if CurrentList.Select(failedTS, testIP(pausedIP)) != -1 {
+			t.Fatalf("declared %t: a stale join brought the failed identity back", declared)
+		}
+	}
+}
+
+// A leave about this node while it stays joined is refuted, not applied
+func TestLeaveOfSelfRefuted(t *testing.T) {
+	self := setupNode(t, "10.0.0.1", 1)
+	handleLeave(encodeTestUpdate(MemUpdateLeave, self.TimeStamp, self.IP))
+	if !isJoined() || CurrentList.IsTombstoned(self.TimeStamp, self.IP) {
+		t.Fatal("node tombstoned itself on a leave of its identity")
+	}
+	if member, err := CurrentList.Retrieve(self.TimeStamp, self.IP); err != nil || member.State != StateAlive {
+		t.Fatalf("self in the list = %v, %v, want alive", member, err)
+	}
+	updates := drainUpdates(t)
+	if updates[MemUpdateResume] == nil || updates[MemUpdateLeave] != nil {
+		t.Fatalf("gossiped %d updates, want only a resume", len(updates))
+	}
+}
+
+// The pause played over loopback sockets: the peer declares the silent
+// node failed by its own timers and flags the ack of the node's next
+// ping, which makes the resumed node rejoin under a new identity
+func TestReadmissionAfterPause(t *testing.T) {
+	const peerIP, pausedIP = "127.0.0.1", "127.0.0.2"
+	const failedTS = uint64(1000)
+	// Acks go to Port, where the paused node reads nothing
+	paused, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(pausedIP), Port: 6666})
+	if err != nil {
+		t.Skip("cannot bind the paused node to", pausedIP+Port, err)
+	}
+	t.Cleanup(func() { paused.Close() })
+
+	setupNode(t, peerIP, 500)
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(peerIP)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	UDPConn = peer
+	goDaemon(func() { udpDaemonHandle(peer) })
+	member := Member{failedTS, testIP(pausedIP), StateAlive, nil}
+	CurrentList.Insert(&member)
+	ping(&member)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, failed := CurrentList.FailedTimeStamp(member.IP); failed {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ts, failed := CurrentList.FailedTimeStamp(member.IP); !failed || ts != failedTS {
+		t.Fatalf("peer FailedTimeStamp = %d, %t, want %d, true", ts, failed, failedTS)
+	}
+
+	// Resumed, the node pings the peer, whose ack tells it was declared failed
+	var packet bytes.Buffer
+	binary.Write(&packet, binary.BigEndian, Header{WireVersion, Ping, 7, 0})
+	paused.WriteToUDP(packet.Bytes(), peer.LocalAddr().(*net.UDPAddr))
+	paused.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var ack []byte
+	for ack == nil {
+		buf := make([]byte, PacketBufferSize)
+		n, _, err := paused.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal("no ack from the peer:", err)
+		}
+		// Skip the pings sent during the pause
+		if n >= 5 && buf[1]&Ack != 0 && binary.BigEndian.Uint16(buf[2:4]) == 8 {
+			ack = buf[:n]
+		}
+	}
+	if ack[4]&AckFailedSender == 0 {
+		t.Fatal("peer acked without AckFailedSender")
+	}
+	// The receive loop of the peer stops on the closed socket
+	daemonCancel()
+	peer.Close()
+	stopNode()
+	paused.SetReadDeadline(time.Time{})
+
+	// The resumed node handles the ack
+	setupNode(t, pausedIP, failedTS)
+	CurrentList.Insert(&Member{500, testIP(peerIP), StateAlive, nil})
+	UDPConn = paused
+	t.Cleanup(func() {
+		daemonCancel()
+		paused.Close()
+		UDPConn = nil
+	})
+	goDaemon(func() { udpDaemonHandle(paused) })
+	sender, err := net.DialUDP("udp4", &net.UDPAddr{IP: net.ParseIP(peerIP)}, paused.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	sender.Write(ack)
+	deadline = time.Now().Add(5 * time.Second)
+	for getCurrentMember().TimeStamp == failedTS && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	self := getCurrentMember()
+	if self.TimeStamp == failedTS || CurrentList.Select(self.TimeStamp, self.IP) == -1 {
+		t.Fatal("resumed node did not rejoin under a new identity")
+	}
+	if updates := drainUpdates(t); updates[MemUpdateLeave] == nil || updates[MemUpdateJoin] == nil {
+		t.Fatal("resumed node did not gossip the leave of its failed identity and its join")
+	}
+}
+
+// Leave pings get distinct seqs, and other control calls are not
+// blocked while the leave waits for its acks
+func TestLeaveInProgress(t *testing.T) {
+	if conn, err := net.Dial("udp", "8.8.8.8:80"); err != nil {
+		t.Skip("no route to look up the local IP after leaving")
+	} else {
+		conn.Close()
+	}
+	self := setupNode(t, "127.0.0.1", 1)
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	UDPConn = conn
+	t.Cleanup(func() {
+		conn.Close()
+		UDPConn = nil
+	})
+	// None of them acks
+	const targets = 50
+	for i := 0; i < targets; i++ {
+		CurrentList.Insert(&Member{uint64(i + 2), testIP("127.0.1." + strconv.Itoa(i)), StateAlive, nil})
+	}
+
+	done := make(chan bool)
+	go func() { done <- Leave(time.Second) }()
+	for !isLeaving() {
+		time.Sleep(time.Millisecond)
+	}
+	leaveMutex.Lock()
+	seqs := len(leaveSeqs)
+	leaveMutex.Unlock()
+	if seqs != targets {
+		t.Errorf("%d leave seqs for %d targets", seqs, targets)
+	}
+	if !controlMutex.TryLock() {
+		t.Error("leave holds controlMutex while waiting for acks")
+	} else {
+		controlMutex.Unlock()
+	}
+	if err := Join(); err != errAlreadyJoined {
+		t.Errorf("Join during a leave = %v, want %v", err, errAlreadyJoined)
+	}
+	if readmit(self.TimeStamp, "127.0.1.0") {
+		t.Error("readmit during a leave rejoined")
+	}
+	if Leave(time.Second) {
+		t.Error("second leave confirmed")
+	}
+
+	if <-done || isJoined() {
+		t.Error("unacked leave confirmed or still joined")
+	}
+}
+
+// Packets of another wire version, such as those of nodes predating
+// it, are dropped before parsing
+func TestWireVersionMismatch(t *testing.T) {
+	setupNode(t, "127.0.0.1", 1)
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		daemonCancel()
+		conn.Close()
+	})
+	goDaemon(func() { udpDaemonHandle(conn) })
+	sender, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	mismatched, received := PacketsMismatched.Value(), PacketsReceived.With("ack").Value()
+	// A pure ack without and with the version, which needs no reply
+	sender.Write([]byte{Ack, 0, 1, 0})
+	sender.Write([]byte{WireVersion, Ack, 0, 1, 0})
+	deadline := time.Now().Add(5 * time.Second)
+	for PacketsReceived.With("ack").Value() == received && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := PacketsMismatched.Value() - mismatched; got != 1 {
+		t.Errorf("%d packets dropped for their version, want 1", got)
+	}
+	if got := PacketsReceived.With("ack").Value() - received; got != 1 {
+		t.Errorf("%d acks received, want 1", got)
+	}
+}
+
+func encodeTestUpdate(updateType uint8, ts uint64, ip uint32) []byte {
+	var buf bytes.Buffer
+	writeUpdate(&buf, &Update{TTLCaches.NewID(), TTL_, updateType, ts, ip, StateAlive, encodeMetadata(nil)})
+	return buf.Bytes()
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNS record types and classes answered
+const (
+	dnsTypeA    = 1
+	dnsTypeSOA  = 6
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+	dnsTypeOPT  = 41
+	dnsTypeANY  = 255
+	dnsClassIN  = 1
+)
+
+// DNS response codes
+const (
+	dnsRcodeOK       = 0
+	dnsRcodeFormErr  = 1
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImp   = 4
+	dnsRcodeRefused  = 5
+)
+
+const (
+	dnsZone       = "ssms."
+	dnsUDPSize    = 512
+	dnsMaxUDPSize = 4096
+	dnsTCPTimeout = 5 * time.Second
+)
+
+// The DNS listeners, nil unless Conf.DNSAddr is set
+var dnsUDPConn *net.UDPConn
+var dnsTCPListener net.Listener
+var dnsMutex sync.Mutex
+
+// DNS queries answered, by record type
+var DNSQueries CounterVec
+
+// A question of a DNS query
+type dnsQuestion struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+// A DNS query, as much of it as the server looks at
+type dnsQuery struct {
+	id       uint16
+	flags    uint16
+	question dnsQuestion
+	raw      []byte
+	// Largest UDP reply the client accepts, from its EDNS0 OPT record
+	udpSize int
+	edns    bool
+}
+
+// Serve the <cluster>.ssms. zone on Conf.DNSAddr over UDP and TCP, if configured
+//
+//	<cluster>.ssms.                     A, SRV  every alive member
+//	<a-b-c-d>.node.<cluster>.ssms.      A       a single alive member
+//
+// Answers are built from CurrentList for every query, so they
+// follow membership changes immediately
+func startDNS() {
+	if Conf.DNSAddr == "" {
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", Conf.DNSAddr)
+	if err != nil {
+		printError(err)
+		fmt.Println(err)
+		return
+	}
+	udpConn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		printError(err)
+		fmt.Println(err)
+		return
+	}
+	tcpListener, err := net.Listen("tcp", Conf.DNSAddr)
+	if err != nil {
+		udpConn.Close()
+		printError(err)
+		fmt.Println(err)
+		return
+	}
+	dnsMutex.Lock()
+	dnsUDPConn = udpConn
+	dnsTCPListener = tcpListener
+	dnsMutex.Unlock()
+	Logger.Info("DNS server listening", F("addr", Conf.DNSAddr), F("zone", dnsClusterName()))
+
+	goDaemon(func() { serveDNSUDP(udpConn) })
+	goDaemon(func() { serveDNSTCP(tcpListener) })
+}
+
+// Close the DNS listeners
+func stopDNS() {
+	dnsMutex.Lock()
+	defer dnsMutex.Unlock()
+	if dnsUDPConn != nil {
+		dnsUDPConn.Close()
+		dnsUDPConn = nil
+	}
+	if dnsTCPListener != nil {
+		dnsTCPListener.Close()
+		dnsTCPListener = nil
+	}
+}
+
+func serveDNSUDP(conn *net.UDPConn) {
+	buffer := make([]byte, dnsMaxUDPSize)
+	for {
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if daemonCtx.Err() != nil {
+				return
+			}
+			printError(err)
+			continue
+		}
+		query, rcode := parseDNSQuery(buffer[:n])
+		if query == nil {
+			continue
+		}
+		reply := answerDNS(query, rcode, query.udpSize)
+		if _, err := conn.WriteToUDP(reply, addr); err != nil {
+			printError(err)
+		}
+	}
+}
+
+func serveDNSTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if daemonCtx.Err() != nil {
+				return
+			}
+			printError(err)
+			continue
+		}
+		goDaemon(func() { serveDNSConn(conn) })
+	}
+}
+
+// Answer the length prefixed queries of a TCP connection until it goes idle
+func serveDNSConn(conn net.Conn) {
+	defer conn.Close()
+	for daemonCtx.Err() == nil {
+		conn.SetDeadline(time.Now().Add(dnsTCPTimeout))
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		buffer := make([]byte, length)
+		if _, err := io.ReadFull(conn, buffer); err != nil {
+			return
+		}
+		query, rcode := parseDNSQuery(buffer)
+		if query == nil {
+			return
+		}
+		reply := answerDNS(query, rcode, 0xffff)
+		prefix := []byte{byte(len(reply) >> 8), byte(len(reply))}
+		if _, err := conn.Write(append(prefix, reply...)); err != nil {
+			return
+		}
+	}
+}
+
+// Parse a query, return nil if it is not worth a reply
+// and a non zero rcode if it is malformed or unsupported
+func parseDNSQuery(msg []byte) (*dnsQuery, int) {
+	if len(msg) < 12 {
+		return nil, dnsRcodeFormErr
+	}
+	query := &dnsQuery{
+		id:      binary.BigEndian.Uint16(msg[0:2]),
+		flags:   binary.BigEndian.Uint16(msg[2:4]),
+		udpSize: dnsUDPSize,
+	}
+	if query.flags&0x8000 != 0 {
+		// A response, never reply to it
+		return nil, dnsRcodeFormErr
+	}
+	if (query.flags>>11)&0xf != 0 {
+		return query, dnsRcodeNotImp
+	}
+	if binary.BigEndian.Uint16(msg[4:6]) != 1 {
+		return query, dnsRcodeFormErr
+	}
+
+	name, offset, err := readDNSName(msg, 12)
+	if err != nil || offset+4 > len(msg) {
+		return query, dnsRcodeFormErr
+	}
+	query.question = dnsQuestion{
+		name:   name,
+		qtype:  binary.BigEndian.Uint16(msg[offset : offset+2]),
+		qclass: binary.BigEndian.Uint16(msg[offset+2 : offset+4]),
+	}
+	query.raw = msg[12 : offset+4]
+	offset += 4
+
+	// Look for an EDNS0 OPT record among the additional records,
+	// skipping the answer and authority ones a query should not have
+	records := int(binary.BigEndian.Uint16(msg[6:8])) + int(binary.BigEndian.Uint16(msg[8:10])) +
+		int(binary.BigEndian.Uint16(msg[10:12]))
+	for i := 0; i < records; i++ {
+		_, offset, err = readDNSName(msg, offset)
+		if err != nil || offset+10 > len(msg) {
+			return query, dnsRcodeFormErr
+		}
+		rrtype := binary.BigEndian.Uint16(msg[offset : offset+2])
+		class := int(binary.BigEndian.Uint16(msg[offset+2 : offset+4]))
+		offset += 10 + int(binary.BigEndian.Uint16(msg[offset+8:offset+10]))
+		if rrtype == dnsTypeOPT {
+			query.edns = true
+			if class > dnsUDPSize {
+				query.udpSize = class
+			}
+			if query.udpSize > dnsMaxUDPSize {
+				query.udpSize = dnsMaxUDPSize
+			}
+		}
+	}
+	return query, dnsRcodeOK
+}
+
+// Read the name at offset, following compression pointers.
+// Return it lowercased with a trailing dot, and the offset past it
+func readDNSName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if offset >= len(msg) {
+			return "", 0, errors.New("Truncated name")
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")) + ".", end, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(msg) || jumps > 16 {
+				return "", 0, errors.New("Invalid name pointer")
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:offset+2]) & 0x3fff)
+			jumps += 1
+		case length&0xc0 != 0:
+			return "", 0, errors.New("Invalid label")
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, errors.New("Truncated name")
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+// Encode name, such as "default.ssms.", in uncompressed wire format
+func dnsName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// Encode a resource record of class IN
+func dnsRecord(name []byte, rrtype uint16, ttl uint32, rdata []byte) []byte {
+	b := append([]byte{}, name...)
+	b = binary.BigEndian.AppendUint16(b, rrtype)
+	b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+	b = binary.BigEndian.AppendUint32(b, ttl)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rdata)))
+	return append(b, rdata...)
+}
+
+// Return the name of the cluster, such as "default.ssms."
+func dnsClusterName() string {
+	return strings.ToLower(strings.Trim(Conf.DNSCluster, ".")) + "." + dnsZone
+}
+
+// Return the name of the member with ip, such as "10-0-0-1.node.default.ssms."
+func dnsNodeName(ip uint32) string {
+	return strings.Replace(int2ip(ip).String(), ".", "-", -1) + ".node." + dnsClusterName()
+}
+
+// Return the members to advertise, alive, not suspected and not unhealthy
+func dnsMembers() []Member {
+	var members []Member
+	for _, m := range CurrentList.Snapshot() {
+		if m.State&StateAlive != 0 && m.State&(StateSuspect|StateDead|StateLeft|StateUnhealthy) == 0 {
+			members = append(members, m)
+		}
+	}
+	return members
+}
+
+// Build the reply to query, no larger than maxSize bytes
+func answerDNS(query *dnsQuery, rcode int, maxSize int) []byte {
+	var answers, additionals [][]byte
+	authoritative := false
+	question := query.question
+	ttl := uint32(Conf.DNSTTL / time.Second)
+	// Answers own the question name, pointed to at offset 12
+	owner := []byte{0xc0, 12}
+
+	if rcode == dnsRcodeOK {
+		DNSQueries.With(dnsTypeName(question.qtype)).Inc()
+		cluster := dnsClusterName()
+		switch {
+		case question.qclass != dnsClassIN && question.qclass != dnsTypeANY:
+			rcode = dnsRcodeRefused
+		case question.name != dnsZone && !strings.HasSuffix(question.name, "."+dnsZone):
+			rcode = dnsRcodeRefused
+		case question.name == cluster:
+			// Members only have IPv4 addresses, AAAA queries get an empty answer
+			authoritative = true
+			for _, m := range dnsMembers() {
+				switch question.qtype {
+				case dnsTypeA, dnsTypeANY:
+					answers = append(answers, dnsRecord(owner, dnsTypeA, ttl, int2ip(m.IP).To4()))
+				case dnsTypeSRV:
+					target := dnsName(dnsNodeName(m.IP))
+					rdata := []byte{0, 1, 0, 1}
+					rdata = binary.BigEndian.AppendUint16(rdata, uint16(Conf.DNSServicePort))
+					rdata = append(rdata, target...)
+					answers = append(answers, dnsRecord(owner, dnsTypeSRV, ttl, rdata))
+					additionals = append(additionals, dnsRecord(target, dnsTypeA, ttl, int2ip(m.IP).To4()))
+				}
+			}
+		case strings.HasSuffix(question.name, ".node."+cluster):
+			authoritative = true
+			rcode = dnsRcodeNXDomain
+			for _, m := range dnsMembers() {
+				if dnsNodeName(m.IP) != question.name {
+					continue
+				}
+				rcode = dnsRcodeOK
+				if question.qtype == dnsTypeA || question.qtype == dnsTypeANY {
+					answers = append(answers, dnsRecord(owner, dnsTypeA, ttl, int2ip(m.IP).To4()))
+				}
+			}
+		case question.name == dnsZone:
+			authoritative = true
+			if question.qtype == dnsTypeSOA || question.qtype == dnsTypeANY {
+				answers = append(answers, dnsSOA(owner, ttl))
+			}
+		default:
+			authoritative = true
+			rcode = dnsRcodeNXDomain
+		}
+	}
+
+	var authorities [][]byte
+	if authoritative && len(answers) == 0 {
+		// Negative answers carry the SOA for caching
+		authorities = append(authorities, dnsSOA(dnsName(dnsZone), ttl))
+	}
+	if query.edns {
+		opt := []byte{0}
+		opt = binary.BigEndian.AppendUint16(opt, dnsTypeOPT)
+		opt = binary.BigEndian.AppendUint16(opt, dnsMaxUDPSize)
+		opt = append(opt, 0, 0, 0, 0, 0, 0)
+		additionals = append(additionals, opt)
+	}
+
+	// QR, opcode and RD of the query, rcode, and AA for the zone
+	flags := 0x8000 | query.flags&0x7900 | uint16(rcode)
+	if authoritative {
+		flags |= 0x0400
+	}
+	msg := make([]byte, 12, dnsUDPSize)
+	binary.BigEndian.PutUint16(msg[0:2], query.id)
+	if query.raw != nil {
+		binary.BigEndian.PutUint16(msg[4:6], 1)
+		msg = append(msg, query.raw...)
+	}
+
+	// Drop the records which do not fit, the answers
+	// must all fit or the reply is marked truncated
+	counts := []int{0, 0, 0}
+sections:
+	for i, records := range [][][]byte{answers, authorities, additionals} {
+		for _, record := range records {
+			if len(msg)+len(record) > maxSize {
+				if i == 0 {
+					flags |= 0x0200
+					break sections
+				}
+				continue
+			}
+			msg = append(msg, record...)
+			counts[i] += 1
+		}
+	}
+	binary.BigEndian.PutUint16(msg[2:4], flags)
+	binary.BigEndian.PutUint16(msg[6:8], uint16(counts[0]))
+	binary.BigEndian.PutUint16(msg[8:10], uint16(counts[1]))
+	binary.BigEndian.PutUint16(msg[10:12], uint16(counts[2]))
+	return msg
+}
+
+// Return the SOA record of the zone, its serial follows membership revisions
+func dnsSOA(owner []byte, ttl uint32) []byte {
+	rdata := append(dnsName("ns."+dnsZone), dnsName("hostmaster."+dnsZone)...)
+	rdata = binary.BigEndian.AppendUint32(rdata, uint32(Events.Revision()))
+	rdata = binary.BigEndian.AppendUint32(rdata, 3600)
+	rdata = binary.BigEndian.AppendUint32(rdata, 600)
+	rdata = binary.BigEndian.AppendUint32(rdata, 86400)
+	rdata = binary.BigEndian.AppendUint32(rdata, ttl)
+	return dnsRecord(owner, dnsTypeSOA, ttl, rdata)
+}
+
+// Return the name of the record type, "other" for the unsupported ones
+func dnsTypeName(qtype uint16) string {
+	switch qtype {
+	case dnsTypeA:
+		return "A"
+	case dnsTypeSOA:
+		return "SOA"
+	case dnsTypeAAAA:
+		return "AAAA"
+	case dnsTypeSRV:
+		return "SRV"
+	case dnsTypeANY:
+		return "ANY"
+	}
+	// Any remote querier picks the type, a label per type is unbounded
+	return "other"
+}
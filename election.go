@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Election rules
+const (
+	ElectOldest   = "oldest"
+	ElectLowestIP = "lowest-ip"
+	ElectPriority = "priority"
+)
+
+// A change of leader, Leader is nil when there is none
+type LeaderChange struct {
+	Revision uint64      `json:"revision"`
+	Leader   *MemberInfo `json:"leader"`
+	Previous *MemberInfo `json:"previous"`
+	IsSelf   bool        `json:"is_self"`
+}
+
+// Picks a leader among the live members by a deterministic rule, so
+// that members with the same member list agree on it without talking
+type Election struct {
+	mu          sync.Mutex
+	rule        string
+	tag         string
+	leader      *MemberInfo
+	subscribers map[chan LeaderChange]bool
+}
+
+// The election of this node, nil if disabled
+var CurrentElection *Election
+
+var errNoElection = errors.New("Election is disabled")
+
+func NewElection(rule string, tag string) (*Election, error) {
+	switch rule {
+	case ElectOldest, ElectLowestIP, ElectPriority:
+	default:
+		return nil, errors.New("Invalid election rule " + rule)
+	}
+	return &Election{rule: rule, tag: tag, subscribers: make(map[chan LeaderChange]bool)}, nil
+}
+
+// Return true if a should lead rather than b
+func (e *Election) before(a, b Member) bool {
+	switch e.rule {
+	case ElectLowestIP:
+		if a.IP != b.IP {
+			return a.IP < b.IP
+		}
+	case ElectPriority:
+		pa, pb := e.priority(a), e.priority(b)
+		if pa != pb {
+			return pa > pb
+		}
+	}
+	// Ties go to the oldest, then to the lowest IP
+	if a.TimeStamp != b.TimeStamp {
+		return a.TimeStamp < b.TimeStamp
+	}
+	return a.IP < b.IP
+}
+
+// Return the priority tag of m, 0 if missing or not a number
+func (e *Election) priority(m Member) float64 {
+	priority, err := strconv.ParseFloat(m.Tags()[e.tag], 64)
+	if err != nil {
+		return 0
+	}
+	return priority
+}
+
+// Elect the leader among the members which are neither dead nor left.
+// A suspected member still leads until it is declared failed
+func (e *Election) elect(members []Member) *MemberInfo {
+	var leader *Member
+	for i := range members {
+		m := &members[i]
+		if m.State&(StateDead|StateLeft) != 0 {
+			continue
+		}
+		if leader == nil || e.before(*m, *leader) {
+			leader = m
+		}
+	}
+	if leader == nil {
+		return nil
+	}
+	info := memberInfo(*leader)
+	return &info
+}
+
+// Return the current leader
+func (e *Election) Leader() (MemberInfo, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.leader == nil {
+		return MemberInfo{}, false
+	}
+	return *e.leader, true
+}
+
+// Elect again from members, publish a change if the leader is another
+func (e *Election) update(revision uint64, members []Member) {
+	leader := e.elect(members)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	previous := e.leader
+	if sameMember(previous, leader) {
+		// Tags may have changed
+		e.leader = leader
+		return
+	}
+	e.leader = leader
+	change := LeaderChange{revision, leader, previous, isSelf(leader)}
+	LeaderChanges.Inc()
+	if leader != nil {
+		Logger.Info("Leader elected", F("leader", leader.IP), F("ts", leader.TimeStamp), F("self", change.IsSelf), F("rule", e.rule))
+	} else {
+		Logger.Info("No leader", F("rule", e.rule))
+	}
+	for ch := range e.subscribers {
+		select {
+		case ch <- change:
+		default:
+			Logger.Warn("Leader subscriber too slow, change dropped", F("revision", revision))
+		}
+	}
+}
+
+func sameMember(a, b *MemberInfo) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP == b.IP && a.TimeStamp == b.TimeStamp
+}
+
+func isSelf(m *MemberInfo) bool {
+	return m != nil && m.IP == LocalIP && m.TimeStamp == getCurrentMember().TimeStamp
+}
+
+// Subscribe to the leader changes, a subscriber whose buffer is full
+// misses them
+func (e *Election) Subscribe(size int) chan LeaderChange {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ch := make(chan LeaderChange, size)
+	e.subscribers[ch] = true
+	return ch
+}
+
+func (e *Election) Unsubscribe(ch chan LeaderChange) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.subscribers[ch] {
+		delete(e.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Return the current leader of this node's election
+func Leader() (MemberInfo, bool, error) {
+	if CurrentElection == nil {
+		return MemberInfo{}, false, errNoElection
+	}
+	leader, ok := CurrentElection.Leader()
+	return leader, ok, nil
+}
+
+// Start the election of Conf.Election, elected again on every
+// membership event
+func startElection() {
+	if Conf.Election == "" {
+		return
+	}
+	election, err := NewElection(Conf.Election, Conf.ElectionTag)
+	if err != nil {
+		printError(err)
+		fmt.Println(err)
+		return
+	}
+	CurrentElection = election
+	Logger.Info("Election", F("rule", election.rule), F("tag", election.tag))
+	// Subscribe before the daemon may join
+	sub, _ := Events.Subscribe(WatchBufferSize, nil)
+	goDaemon(func() { runElection(election, sub) })
+}
+
+// Elect once the events settled for ElectionSettle, so that a burst
+// of events, such as the members of an init reply, elects once
+func runElection(election *Election, sub *Subscription) {
+	defer func() { Events.Unsubscribe(sub) }()
+	settle := time.NewTimer(ElectionSettle)
+	settle.Stop()
+	defer settle.Stop()
+	var revision uint64
+	left := false
+
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				// Fell behind, the member list has every missed change
+				sub, _ = Events.Subscribe(WatchBufferSize, nil)
+				revision = Events.Revision()
+			} else if event.Type == EventSuspect || event.Type == EventResume {
+				continue
+			} else {
+				revision = event.Revision
+				left = event.Type == EventLeave && event.Self
+			}
+			settle.Reset(ElectionSettle)
+		case <-settle.C:
+			var members []Member
+			// Out of the group, there is no leader until joining again
+			if isJoined() && !left {
+				members = CurrentList.Snapshot()
+			}
+			election.update(revision, members)
+		case <-daemonCtx.Done():
+			return
+		}
+	}
+}
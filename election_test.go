@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// The leave of an old identity of this node, after a readmission,
+// does not stop the election
+func TestElectionOldIdentityLeave(t *testing.T) {
+	self := setupNode(t, "10.0.0.1", 2)
+	CurrentList.Insert(&Member{1, self.IP, StateAlive, nil})
+	election, _ := NewElection(ElectOldest, "")
+	sub, _ := Events.Subscribe(WatchBufferSize, nil)
+	goDaemon(func() { runElection(election, sub) })
+
+	CurrentList.MarkDead(1, self.IP, StateLeft)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if leader, ok := election.Leader(); ok {
+			if leader.IP != "10.0.0.1" || leader.TimeStamp != 2 {
+				t.Errorf("leader %s %d, want this node", leader.IP, leader.TimeStamp)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+}
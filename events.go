@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Membership event types
+const (
+	EventJoin    = "join"
+	EventSuspect = "suspect"
+	EventResume  = "resume"
+	EventLeave   = "leave"
+	EventFailed  = "failed"
+	EventUpdate  = "update"
+)
+
+// A membership change, numbered by an increasing revision
+type MemberEvent struct {
+	Revision uint64     `json:"revision"`
+	Type     string     `json:"type"`
+	Member   MemberInfo `json:"member"`
+	Time     time.Time  `json:"time"`
+	// About the identity this node had when the event was published,
+	// which a leave or a readmission replaces before subscribers see it
+	Self bool `json:"-"`
+}
+
+// Receives events published after Subscribe. C is closed when the
+// subscriber falls behind and events had to be dropped, or on Unsubscribe
+type Subscription struct {
+	C      chan MemberEvent
+	closed bool
+}
+
+// Fans out membership events to subscribers and keeps the recent
+// ones, so that reconnecting clients can resume from a revision
+type EventBus struct {
+	mu          sync.Mutex
+	revision    uint64
+	history     []MemberEvent
+	historySize int
+	subscribers map[*Subscription]bool
+}
+
+// Membership events of this node, published by MemberList
+var Events = NewEventBus(WatchHistorySize)
+
+func NewEventBus(historySize int) *EventBus {
+	return &EventBus{historySize: historySize, subscribers: make(map[*Subscription]bool)}
+}
+
+// Number the event and deliver it to every subscriber without blocking
+func (b *EventBus) Publish(eventType string, m Member) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.revision += 1
+	self := getCurrentMember()
+	mine := self != nil && self.TimeStamp == m.TimeStamp && self.IP == m.IP
+	event := MemberEvent{b.revision, eventType, memberInfo(m), time.Now().UTC(), mine}
+
+	b.history = append(b.history, event)
+	if len(b.history) > b.historySize {
+		b.history = b.history[len(b.history)-b.historySize:]
+	}
+	for sub := range b.subscribers {
+		select {
+		case sub.C <- event:
+		default:
+			// Too slow, let it resubscribe from its last revision
+			b.closeLocked(sub)
+		}
+	}
+}
+
+// Return the revision of the last published event
+func (b *EventBus) Revision() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.revision
+}
+
+// Subscribe to the events published from now on. If since is not nil,
+// the events after revision *since are delivered first; ok is false if
+// they are no longer kept and the subscriber must start from a snapshot
+func (b *EventBus) Subscribe(size int, since *uint64) (sub *Subscription, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var missed []MemberEvent
+	if since != nil {
+		if *since > b.revision {
+			return nil, false
+		}
+		if *since < b.revision {
+			if len(b.history) == 0 || b.history[0].Revision > *since+1 {
+				return nil, false
+			}
+			missed = b.history[*since+1-b.history[0].Revision:]
+		}
+	}
+	sub = &Subscription{C: make(chan MemberEvent, size+len(missed))}
+	for _, event := range missed {
+		sub.C <- event
+	}
+	b.subscribers[sub] = true
+	return sub, true
+}
+
+func (b *EventBus) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closeLocked(sub)
+}
+
+func (b *EventBus) closeLocked(sub *Subscription) {
+	if !sub.closed {
+		sub.closed = true
+		close(sub.C)
+		delete(b.subscribers, sub)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An event as passed to the handlers, a membership change
+// or a user event
+type handlerEvent struct {
+	Name      string
+	Member    *MemberEvent
+	UserEvent *UserEvent
+}
+
+// Names of the events accepted, such as "member-join", "user" for every
+// user event or "user:deploy" for one. Empty accepts every event
+type EventFilter []string
+
+// A script run on the events matching its filter, one at a time
+type EventHandler struct {
+	Filter  EventFilter
+	Command string
+	queue   chan handlerEvent
+}
+
+// Split a spec such as "member-join,member-failed=target" into its
+// filter and target. A spec without filter is a target for every event
+func splitEventSpec(spec string) (EventFilter, string) {
+	if filters, target, ok := strings.Cut(spec, "="); ok && validFilters(filters) {
+		return strings.Split(filters, ","), target
+	}
+	return nil, spec
+}
+
+// Parse a handler spec such as "member-join,member-failed=script.sh"
+func ParseEventHandler(spec string) (*EventHandler, error) {
+	filter, command := splitEventSpec(spec)
+	if strings.TrimSpace(command) == "" {
+		return nil, errors.New("Invalid event handler " + spec)
+	}
+	return &EventHandler{Filter: filter, Command: command}, nil
+}
+
+func validFilters(filters string) bool {
+	for _, filter := range strings.Split(filters, ",") {
+		switch filter {
+		case "*", "member-join", "member-leave", "member-failed", "member-suspect",
+			"member-resume", "member-update", "user":
+		default:
+			if !strings.HasPrefix(filter, "user:") || len(filter) == len("user:") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Return true if the event named name is accepted, such as
+// "member-join", or "user:deploy" for the user event deploy
+func (f EventFilter) Match(name string) bool {
+	if len(f) == 0 {
+		return true
+	}
+	for _, filter := range f {
+		if filter == "*" || filter == name || (filter == "user" && strings.HasPrefix(name, "user:")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Start the handlers of Conf.EventHandlers, each runs in its own
+// goroutine and is fed by a dispatcher of the membership and user events
+func startHandlers() {
+	var handlers []*EventHandler
+	for _, spec := range Conf.EventHandlers {
+		handler, err := ParseEventHandler(spec)
+		if err != nil {
+			printError(err)
+			fmt.Println(err)
+			continue
+		}
+		handler.queue = make(chan handlerEvent, HandlerQueueSize)
+		handlers = append(handlers, handler)
+		Logger.Info("Event handler", F("filters", strings.Join(handler.Filter, ",")), F("command", handler.Command))
+		goDaemon(handler.run)
+	}
+	if len(handlers) == 0 {
+		return
+	}
+	// Subscribe before the daemon may join
+	userEvents := UserEvents.Subscribe(WatchBufferSize)
+	sub, _ := Events.Subscribe(WatchBufferSize, nil)
+	goDaemon(func() { dispatchHandlerEvents(handlers, sub, userEvents) })
+}
+
+// Fan out the events to the matching handlers, without blocking
+func dispatchHandlerEvents(handlers []*EventHandler, sub *Subscription, userEvents chan UserEvent) {
+	defer UserEvents.Unsubscribe(userEvents)
+	defer func() { Events.Unsubscribe(sub) }()
+	revision := Events.Revision()
+
+	for {
+		var event handlerEvent
+		select {
+		case member, ok := <-sub.C:
+			if !ok {
+				// Fell behind, catch up from the last revision handled
+				var resumed bool
+				sub, resumed = Events.Subscribe(WatchBufferSize, &revision)
+				if !resumed {
+					Logger.Warn("Event handlers missed membership events", F("revision", revision))
+					sub, _ = Events.Subscribe(WatchBufferSize, nil)
+					revision = Events.Revision()
+				}
+				continue
+			}
+			revision = member.Revision
+			event = handlerEvent{"member-" + member.Type, &member, nil}
+		case user := <-userEvents:
+			event = handlerEvent{"user:" + user.Name, nil, &user}
+		case <-daemonCtx.Done():
+			return
+		}
+		for _, handler := range handlers {
+			if !handler.Filter.Match(event.Name) {
+				continue
+			}
+			select {
+			case handler.queue <- event:
+			default:
+				HandlerRuns.With("dropped").Inc()
+				Logger.Warn("Event handler queue full, event dropped", F("command", handler.Command), F("event", event.Name))
+			}
+		}
+	}
+}
+
+// Run the handler on its events one at a time. Membership events of the
+// same type already queued are passed together
+func (h *EventHandler) run() {
+	for {
+		var event handlerEvent
+		select {
+		case event = <-h.queue:
+		case <-daemonCtx.Done():
+			return
+		}
+		events := []handlerEvent{event}
+		for batching := event.Member != nil; batching; {
+			select {
+			case next := <-h.queue:
+				events = append(events, next)
+				batching = next.Name == event.Name
+			default:
+				batching = false
+			}
+		}
+		// The last one may be of another type
+		if last := events[len(events)-1]; last.Name != event.Name {
+			events = events[:len(events)-1]
+			h.invoke(events)
+			events = []handlerEvent{last}
+		}
+		h.invoke(events)
+	}
+}
+
+// Exec the command with the events, which are all of the same type
+func (h *EventHandler) invoke(events []handlerEvent) {
+	event := events[0]
+	self := getCurrentMember()
+	env := append(os.Environ(),
+		"SSMS_EVENT="+strings.SplitN(event.Name, ":", 2)[0],
+		"SSMS_SELF_IP="+LocalIP,
+		"SSMS_SELF_TIMESTAMP="+strconv.FormatUint(self.TimeStamp, 10),
+	)
+	for key, value := range self.Tags() {
+		env = append(env, "SSMS_TAG_"+strings.ToUpper(key)+"="+value)
+	}
+	var stdin bytes.Buffer
+	if event.UserEvent != nil {
+		env = append(env,
+			"SSMS_USER_EVENT="+event.UserEvent.Name,
+			"SSMS_USER_LTIME="+strconv.FormatUint(event.UserEvent.LTime, 10),
+			"SSMS_USER_FROM="+event.UserEvent.From,
+		)
+		stdin.Write(event.UserEvent.Payload)
+	} else {
+		env = append(env, "SSMS_REVISION="+strconv.FormatUint(events[len(events)-1].Member.Revision, 10))
+		// One line per member: IP, timestamp, state and tags
+		for _, e := range events {
+			m := e.Member.Member
+			fmt.Fprintf(&stdin, "%s\t%d\t%s\t%s\n", m.IP, m.TimeStamp, m.State, m.Tags)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(daemonCtx, Conf.HandlerTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", h.Command)
+	cmd.Env = env
+	cmd.Stdin = &stdin
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// Background children of the script may hold the output open
+	cmd.WaitDelay = time.Second
+
+	start := time.Now()
+	err := cmd.Run()
+	fields := []Field{F("command", h.Command), F("event", event.Name), F("members", len(events))}
+	scanner := bufio.NewScanner(&output)
+	for scanner.Scan() {
+		Logger.Info("Event handler output", append(fields, F("line", scanner.Text()))...)
+	}
+	fields = append(fields, F("duration", time.Since(start).String()))
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		HandlerRuns.With("timeout").Inc()
+		Logger.Warn("Event handler timeout", fields...)
+	case err != nil:
+		HandlerRuns.With("failed").Inc()
+		Logger.Warn("Event handler failed", append(fields, F("err", err))...)
+	default:
+		HandlerRuns.With("ok").Inc()
+		Logger.Debug("Event handler done", fields...)
+	}
+}
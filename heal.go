@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// A member declared failed, contacted again until Conf.ReconnectLimit
+// elapsed in case it was only cut off by a partition
+type failedMember struct {
+	Member   MemberInfo
+	FailedAt time.Time
+}
+
+var failedMembers = make(map[[2]uint64]failedMember)
+
+// mutex used for failedMembers
+var failedMutex sync.Mutex
+
+// Remember the failed members and contact one of them every
+// Conf.ReconnectPeriod, so that the halves of a healed partition meet
+func startHealing() {
+	if Conf.ReconnectPeriod <= 0 {
+		return
+	}
+	// Subscribe before the daemon may join
+	sub, _ := Events.Subscribe(WatchBufferSize, nil)
+	goDaemon(func() { trackFailedMembers(sub) })
+	goDaemon(periodicReconnect)
+}
+
+func trackFailedMembers(sub *Subscription) {
+	defer func() { Events.Unsubscribe(sub) }()
+
+	for {
+		var event MemberEvent
+		var ok bool
+		select {
+		case event, ok = <-sub.C:
+		case <-daemonCtx.Done():
+			return
+		}
+		if !ok {
+			// Fell behind, the failures missed are not contacted
+			Logger.Warn("Healing missed membership events")
+			sub, _ = Events.Subscribe(WatchBufferSize, nil)
+			continue
+		}
+		key := [2]uint64{event.Member.TimeStamp, uint64(ip2int(net.ParseIP(event.Member.IP)))}
+		failedMutex.Lock()
+		switch event.Type {
+		case EventFailed:
+			if event.Member.IP != LocalIP {
+				failedMembers[key] = failedMember{event.Member, time.Now()}
+			}
+		case EventJoin, EventLeave:
+			// Back in the list, or gone on purpose
+			delete(failedMembers, key)
+			if event.Member.IP == LocalIP && event.Type == EventLeave {
+				failedMembers = make(map[[2]uint64]failedMember)
+			}
+		}
+		failedMutex.Unlock()
+	}
+}
+
+// Pick a random failed member to contact. Those failed for longer than
+// Conf.ReconnectLimit are forgotten, and those whose IP is in the list
+// again, restarted with another identity, are skipped
+func pickFailedMember() (MemberInfo, bool) {
+	failedMutex.Lock()
+	defer failedMutex.Unlock()
+	var candidates []MemberInfo
+	for key, failed := range failedMembers {
+		if time.Since(failed.FailedAt) > Conf.ReconnectLimit {
+			delete(failedMembers, key)
+			continue
+		}
+		if !CurrentList.ContainsIP(uint32(key[1])) {
+			candidates = append(candidates, failed.Member)
+		}
+	}
+	if len(candidates) == 0 {
+		return MemberInfo{}, false
+	}
+	return candidates[rand.Intn(len(candidates))], true
+}
+
+func periodicReconnect() {
+	for sleepDaemon(Conf.ReconnectPeriod) {
+		if !isJoined() {
+			continue
+		}
+		member, ok := pickFailedMember()
+		if !ok {
+			continue
+		}
+		ReconnectAttempts.Inc()
+		Logger.Debug("Reconnect failed member", F("member", member.IP), F("ts", member.TimeStamp))
+		sendDirect(ip2int(net.ParseIP(member.IP)), DirectPushPull, encodeState())
+	}
+}
+
+// Encode this node followed by the live members, as many as fit
+// in MaxPushPullSize
+func encodeState() []byte {
+	var binBuffer bytes.Buffer
+	writeMember(&binBuffer, getCurrentMember())
+	for _, member := range CurrentList.Snapshot() {
+		var memberBuffer bytes.Buffer
+		writeMember(&memberBuffer, &member)
+		if binBuffer.Len()+memberBuffer.Len() > MaxPushPullSize {
+			Logger.Warn("Member list exceeds the push pull size, truncated", F("members", CurrentList.Size()))
+			break
+		}
+		binBuffer.Write(memberBuffer.Bytes())
+	}
+	return binBuffer.Bytes()
+}
+
+// Merge the state of another member, sent first in it, and answer a push
+// with this node's state so that both sides converge
+func handlePushPull(kind uint8, payload []byte) {
+	var members []Member
+	buf := bytes.NewReader(payload)
+	for buf.Len() > 0 {
+		member, err := readMember(buf)
+		if err != nil {
+			printError(err)
+			return
+		}
+		members = append(members, member)
+	}
+	if len(members) == 0 || members[0].IP == getCurrentMember().IP {
+		return
+	}
+	from := int2ip(members[0].IP).String()
+	if kind == DirectPushPull {
+		sendDirect(members[0].IP, DirectPushPullReply, encodeState())
+	}
+	if healed := mergeState(members); healed > 0 {
+		PartitionHeals.Inc()
+		MembersHealed.Add(uint64(healed))
+		Logger.Info("Partition healed", F("from", from), F("members", healed))
+	}
+}
+
+// Insert the members missing from the list, unless they left, and
+// gossip them to the rest of this side. A member declared dead here
+// only comes back on its own word, as the sender of the state, since
+// a peer still listing it may not have learned of the failure yet. Its
+// heal lifts the tombstones of this side, the other members are
+// gossiped as joins, which tombstones hold off. Return how many were
+// inserted
+func mergeState(members []Member) int {
+	healed := 0
+	for i := range members {
+		member := members[i]
+		if member.IP == getCurrentMember().IP || member.State&(StateDead|StateLeft) != 0 {
+			continue
+		}
+		tombstoned := CurrentList.IsTombstoned(member.TimeStamp, member.IP)
+		if tombstoned && i > 0 {
+			continue
+		}
+		if err := CurrentList.Resurrect(&member); err != nil {
+			// Known member, its tags may be newer
+			CurrentList.SetMetadata(member.TimeStamp, member.IP, member.Meta)
+			continue
+		}
+		healed += 1
+		if tombstoned {
+			addUpdate2Cache(&member, MemUpdateHeal)
+		} else {
+			addUpdate2Cache(&member, MemUpdateJoin)
+		}
+	}
+	return healed
+}
+
+// Insert a member healed by another, even though it has a tombstone
+// on this side which would ignore its join
+func handleHeal(update *Update) {
+	if update.MemberIP == getCurrentMember().IP {
+		return
+	}
+	meta, err := readMetadata(bytes.NewReader(update.Payload))
+	printError(err)
+	member := Member{update.MemberTimeStamp, update.MemberIP, update.MemberState, meta}
+	if err := CurrentList.Resurrect(&member); err == nil {
+		Logger.Info("Member healed", F("member", int2ip(member.IP).String()), F("ts", member.TimeStamp), F("update_id", update.UpdateID))
+	}
+}
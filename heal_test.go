@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestMergeState(t *testing.T) {
+	setupNode(t, "10.0.0.1", 1)
+	for _, m := range []Member{{2, testIP("10.0.0.2"), StateAlive, nil}, {3, testIP("10.0.0.3"), StateAlive, nil}, {4, testIP("10.0.0.4"), StateAlive, nil}} {
+		member := m
+		CurrentList.Insert(&member)
+	}
+	CurrentList.MarkDead(2, testIP("10.0.0.2"), StateDead)
+	CurrentList.MarkDead(3, testIP("10.0.0.3"), StateDead)
+	CurrentList.MarkDead(4, testIP("10.0.0.4"), StateLeft)
+	drainUpdates(t)
+
+	// The state of 10.0.0.2, listing members this node declared dead or
+	// saw leave, and one it does not know
+	healed := mergeState([]Member{
+		{2, testIP("10.0.0.2"), StateAlive, nil},
+		{3, testIP("10.0.0.3"), StateAlive, nil},
+		{4, testIP("10.0.0.4"), StateAlive, nil},
+		{5, testIP("10.0.0.5"), StateAlive, nil},
+	})
+	if healed != 2 {
+		t.Errorf("%d members inserted, want the sender and the unknown one", healed)
+	}
+	tests := []struct {
+		ts     uint64
+		ip     string
+		listed bool
+	}{
+		{2, "10.0.0.2", true},
+		{3, "10.0.0.3", false},
+		{4, "10.0.0.4", false},
+		{5, "10.0.0.5", true},
+	}
+	for _, tt := range tests {
+		if listed := CurrentList.Select(tt.ts, testIP(tt.ip)) != -1; listed != tt.listed {
+			t.Errorf("%s listed %t, want %t", tt.ip, listed, tt.listed)
+		}
+	}
+	// Only the sender is healed on this side, the unknown member joins
+	updates := drainUpdates(t)
+	if len(updates) != 2 || updates[MemUpdateHeal] == nil || updates[MemUpdateJoin] == nil {
+		t.Errorf("gossiped %d updates, want a heal and a join", len(updates))
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Health of a member, the state bits it advertises besides StateAlive
+const (
+	HealthOK        = 0x00
+	HealthDegraded  = StateDegraded
+	HealthUnhealthy = StateUnhealthy
+	HealthMask      = StateDegraded | StateUnhealthy
+)
+
+// Check the service fronted by this node. Return nil if it is healthy,
+// an error wrapping ErrDegraded if degraded, any other one if unhealthy
+type HealthCheck func(ctx context.Context) error
+
+var ErrDegraded = errors.New("Degraded")
+
+// The last result of a health check
+type HealthResult struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	Output    string    `json:"output,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+var healthChecks = make(map[string]HealthCheck)
+var healthResults = make([]HealthResult, 0)
+
+// Health versions of the other members, a health update older than
+// the last one applied is ignored
+var healthVersions = make(map[[2]uint64]uint64)
+
+// mutex used for healthChecks, healthResults and healthVersions
+var healthMutex sync.Mutex
+
+// Return the readable name of the health bits of state
+func healthName(state uint8) string {
+	switch {
+	case state&StateUnhealthy != 0:
+		return "unhealthy"
+	case state&StateDegraded != 0:
+		return "degraded"
+	}
+	return "healthy"
+}
+
+// Register the health check named name, replacing any. It runs
+// every Conf.HealthInterval. Only the checks of Conf.HealthChecks are
+// registered, package main cannot be imported to add others
+func RegisterHealthCheck(name string, check HealthCheck) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	healthChecks[name] = check
+}
+
+// Parse a health check spec, "[name=]http://host/path", "[name=]tcp://host:port"
+// or "[name=]exec:command". The name defaults to the spec
+func ParseHealthCheck(spec string) (string, HealthCheck, error) {
+	name, target := spec, spec
+	if i := strings.Index(spec, "="); i > 0 && !strings.Contains(spec[:i], ":") {
+		name, target = spec[:i], spec[i+1:]
+	}
+	switch {
+	case strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://"):
+		return name, httpHealthCheck(target), nil
+	case strings.HasPrefix(target, "tcp://"):
+		addr := strings.TrimPrefix(target, "tcp://")
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return "", nil, errors.New("Invalid health check address " + addr)
+		}
+		return name, tcpHealthCheck(addr), nil
+	case strings.HasPrefix(target, "exec:") && len(target) > len("exec:"):
+		return name, execHealthCheck(strings.TrimPrefix(target, "exec:")), nil
+	}
+	return "", nil, errors.New("Invalid health check " + spec)
+}
+
+// Pass on a 2xx response, degrade on 429, fail otherwise
+func httpHealthCheck(url string) HealthCheck {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("User-Agent", "ssms")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode/100 == 2:
+			return nil
+		case resp.StatusCode == http.StatusTooManyRequests:
+			return fmt.Errorf("%w: %s responded %s", ErrDegraded, url, resp.Status)
+		}
+		return errors.New(url + " responded " + resp.Status)
+	}
+}
+
+// Pass if addr accepts a connection
+func tcpHealthCheck(addr string) HealthCheck {
+	return func(ctx context.Context) error {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+	}
+}
+
+// Pass on exit code 0, degrade on 1, fail otherwise. The output of
+// the command is reported as the error
+func execHealthCheck(command string) HealthCheck {
+	return func(ctx context.Context) error {
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+		var output bytes.Buffer
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		// Background children of the script may hold the output open
+		cmd.WaitDelay = time.Second
+		err := cmd.Run()
+		if err == nil {
+			return nil
+		}
+		message := strings.TrimSpace(output.String())
+		if message == "" {
+			message = err.Error()
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 && ctx.Err() == nil {
+			return fmt.Errorf("%w: %s", ErrDegraded, message)
+		}
+		return errors.New(message)
+	}
+}
+
+// Register the checks of Conf.HealthChecks and run every registered
+// check each Conf.HealthInterval
+func startHealthChecks() {
+	for _, spec := range Conf.HealthChecks {
+		name, check, err := ParseHealthCheck(spec)
+		if err != nil {
+			printError(err)
+			fmt.Println(err)
+			continue
+		}
+		RegisterHealthCheck(name, check)
+		Logger.Info("Health check", F("name", name), F("interval", Conf.HealthInterval.String()))
+	}
+	goDaemon(func() {
+		for {
+			runHealthChecks()
+			if !sleepDaemon(Conf.HealthInterval) {
+				return
+			}
+		}
+	})
+}
+
+// Run every check at once, and advertise the worst result as the
+// health of this node
+func runHealthChecks() {
+	healthMutex.Lock()
+	checks := make(map[string]HealthCheck, len(healthChecks))
+	for name, check := range healthChecks {
+		checks[name] = check
+	}
+	healthMutex.Unlock()
+	if len(checks) == 0 {
+		return
+	}
+
+	results := make([]HealthResult, 0, len(checks))
+	var resultsMutex sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check HealthCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(daemonCtx, Conf.HealthTimeout)
+			defer cancel()
+			result := HealthResult{Name: name, Status: healthName(HealthOK)}
+			if err := check(ctx); err != nil {
+				result.Output = err.Error()
+				if errors.Is(err, ErrDegraded) {
+					result.Status = healthName(HealthDegraded)
+				} else {
+					result.Status = healthName(HealthUnhealthy)
+				}
+			}
+			result.CheckedAt = time.Now().UTC()
+			HealthChecksRun.With(result.Status).Inc()
+			resultsMutex.Lock()
+			results = append(results, result)
+			resultsMutex.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+	// Checks cancelled by the shutdown did not fail
+	if daemonCtx.Err() != nil {
+		return
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+
+	health := uint8(HealthOK)
+	var failing []string
+	for _, result := range results {
+		switch result.Status {
+		case healthName(HealthUnhealthy):
+			health |= HealthUnhealthy
+		case healthName(HealthDegraded):
+			health |= HealthDegraded
+		default:
+			continue
+		}
+		failing = append(failing, result.Name)
+	}
+	if health&HealthUnhealthy != 0 {
+		health = HealthUnhealthy
+	}
+	healthMutex.Lock()
+	healthResults = results
+	healthMutex.Unlock()
+	setHealth(health, failing)
+}
+
+// Return the last results of the health checks, sorted by name
+func HealthResults() []HealthResult {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	return append([]HealthResult(nil), healthResults...)
+}
+
+// Advertise the health of this node, gossiped if it is in the group
+func setHealth(health uint8, failing []string) {
+	controlMutex.Lock()
+	defer controlMutex.Unlock()
+	self := *getCurrentMember()
+	if self.State&HealthMask == health {
+		return
+	}
+	HealthChanges.Inc()
+	fields := []Field{F("health", healthName(health)), F("failing", strings.Join(failing, ","))}
+	if health == HealthOK {
+		Logger.Info("Health changed", fields...)
+	} else {
+		Logger.Warn("Health changed", fields...)
+	}
+	CurrentList.SetHealth(self.TimeStamp, self.IP, health)
+	self.State = self.State&^HealthMask | health
+	setCurrentMember(&self)
+	if !isJoined() {
+		return
+	}
+	// The update carries a version, gossip may deliver changes out of order
+	var payload bytes.Buffer
+	binary.Write(&payload, binary.BigEndian, uint64(time.Now().UnixNano()))
+	uid := TTLCaches.NewID()
+	update := Update{uid, TTL_, MemUpdateHealth, self.TimeStamp, self.IP, self.State, payload.Bytes()}
+	TTLCaches.Set(&update)
+	isUpdateDuplicate(uid)
+}
+
+// Handle a health update, the member advertises a new health
+func handleHealth(update *Update) {
+	if isCurrentMember(update.MemberTimeStamp, update.MemberIP) {
+		return
+	}
+	var version uint64
+	if err := binary.Read(bytes.NewReader(update.Payload), binary.BigEndian, &version); err != nil {
+		printError(err)
+		return
+	}
+	key := [2]uint64{update.MemberTimeStamp, uint64(update.MemberIP)}
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	if version <= healthVersions[key] {
+		return
+	}
+	if err := CurrentList.SetHealth(update.MemberTimeStamp, update.MemberIP, update.MemberState&HealthMask); err != nil {
+		// Unknown member, its join carries its health
+		return
+	}
+	healthVersions[key] = version
+	// Forget the members gone meanwhile
+	if len(healthVersions) > 2*CurrentList.Size() {
+		for key := range healthVersions {
+			if CurrentList.Select(key[0], uint32(key[1])) == -1 {
+				delete(healthVersions, key)
+			}
+		}
+	}
+}
+
+// Return true if the health of info is one of health, or if health is empty
+func healthMatch(health []string, info MemberInfo) bool {
+	if len(health) == 0 {
+		return true
+	}
+	for _, name := range health {
+		if name == info.Health {
+			return true
+		}
+	}
+	return false
+}
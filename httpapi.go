@@ -0,0 +1,600 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The admin HTTP server, nil unless Conf.HTTPAddr is set
+var httpServer *http.Server
+
+type healthReply struct {
+	Status  string `json:"status"`
+	Joined  bool   `json:"joined"`
+	Members int    `json:"members"`
+}
+
+type leaveReply struct {
+	Confirmed bool `json:"confirmed"`
+}
+
+type errorReply struct {
+	Error string `json:"error"`
+}
+
+type watchSnapshot struct {
+	Revision uint64       `json:"revision"`
+	Members  []MemberInfo `json:"members"`
+}
+
+// Serve the admin API on Conf.HTTPAddr, if configured
+func startHTTP() {
+	if Conf.HTTPAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/members", httpMembers)
+	mux.HandleFunc("/v1/self", httpSelf)
+	mux.HandleFunc("/v1/self/tags", httpTags)
+	mux.HandleFunc("/v1/health", httpHealth)
+	mux.HandleFunc("/v1/join", httpJoin)
+	mux.HandleFunc("/v1/leave", httpLeave)
+	mux.HandleFunc("/v1/loglevel", httpLogLevel)
+	mux.HandleFunc("/v1/watch", httpWatch)
+	mux.HandleFunc("/v1/event/", httpUserEvent)
+	mux.HandleFunc("/v1/events", httpUserEvents)
+	mux.HandleFunc("/v1/query/", httpQuery)
+	mux.HandleFunc("/v1/coordinates", httpCoordinates)
+	mux.HandleFunc("/v1/rtt", httpRTT)
+	mux.HandleFunc("/v1/ring", httpRing)
+	mux.HandleFunc("/v1/ring/owners", httpRingOwners)
+	mux.HandleFunc("/v1/ring/watch", httpRingWatch)
+	mux.HandleFunc("/v1/leader", httpLeader)
+	mux.HandleFunc("/v1/leader/watch", httpLeaderWatch)
+	mux.HandleFunc("/metrics", httpMetrics)
+
+	listener, err := net.Listen("tcp", Conf.HTTPAddr)
+	if err != nil {
+		printError(err)
+		fmt.Println(err)
+		return
+	}
+	// No write timeout, the watch and query streams stay open
+	httpServer = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: HTTPHeaderTimeout,
+		IdleTimeout:       HTTPIdleTimeout,
+	}
+	Logger.Info("HTTP API listening", F("addr", listener.Addr().String()))
+	goDaemon(func() {
+		err := httpServer.Serve(listener)
+		if err != http.ErrServerClosed {
+			printError(err)
+		}
+	})
+}
+
+// Gracefully stop the admin HTTP server
+func stopHTTP(ctx context.Context) {
+	if httpServer != nil {
+		httpServer.Shutdown(ctx)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, errorReply{err.Error()})
+}
+
+// Reply 405 and return false unless the request uses method
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+		return false
+	}
+	return true
+}
+
+// GET /v1/members?state=alive,suspect,dead,left&health=healthy,degraded&tag=role=db&near=self
+// Without state filter the live members are returned,
+// with health filter only the members of the given health,
+// with tag filters only the members having every tag,
+// with near sorted by estimated RTT from this node or the given IP
+func httpMembers(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	filter, err := ParseTags(r.URL.Query()["tag"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	states := make(map[string]bool)
+	for _, state := range strings.Split(r.URL.Query().Get("state"), ",") {
+		if state != "" {
+			states[state] = true
+		}
+	}
+	var health []string
+	if h := r.URL.Query().Get("health"); h != "" {
+		health = strings.Split(h, ",")
+	}
+	all := states["dead"] || states["left"]
+	members := make([]MemberInfo, 0)
+	for _, m := range memberInfos(all, filter) {
+		if (len(states) == 0 || states[m.State]) && healthMatch(health, m) {
+			members = append(members, m)
+		}
+	}
+	if near := r.URL.Query().Get("near"); near != "" {
+		if err := sortByDistance(near, members); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, members)
+}
+
+// GET /v1/coordinates, the network coordinates known by IP
+func httpCoordinates(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, Coordinates.All())
+}
+
+// GET /v1/rtt?a=ip&b=ip, the estimated RTT between two members,
+// this node stands for a missing one
+func httpRTT(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	a, b := r.URL.Query().Get("a"), r.URL.Query().Get("b")
+	rtt, err := EstimateRTT(a, b)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"a": a, "b": b, "rtt_ns": rtt, "rtt": rtt.String()})
+}
+
+// GET /v1/self
+func httpSelf(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, selfInfo())
+}
+
+// PUT /v1/self/tags with a JSON object of tags, replacing them all
+func httpTags(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPut) {
+		return
+	}
+	var tags Tags
+	if err := json.NewDecoder(r.Body).Decode(&tags); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := SetTags(tags); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, selfInfo())
+}
+
+// GET /v1/health, 200 when this node is in the group and its health
+// checks are not failing, 503 otherwise
+func httpHealth(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	state := getCurrentMember().State
+	reply := healthReply{healthName(state), isJoined(), CurrentList.Size()}
+	code := http.StatusOK
+	if !reply.Joined {
+		reply.Status = "not joined"
+		code = http.StatusServiceUnavailable
+	} else if state&StateUnhealthy != 0 {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, reply)
+}
+
+// POST /v1/join
+func httpJoin(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	if err := Join(); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, selfInfo())
+}
+
+// POST /v1/leave?timeout=5s
+func httpLeave(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	timeout := LeaveTimeoutPeriod
+	if s := r.URL.Query().Get("timeout"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		timeout = d
+	}
+	if CurrentList.Size() < 1 {
+		writeError(w, http.StatusConflict, errNotJoined)
+		return
+	}
+	writeJSON(w, http.StatusOK, leaveReply{Leave(timeout)})
+}
+
+// PUT /v1/loglevel?level=debug
+func httpLogLevel(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPut) {
+		return
+	}
+	level, err := ParseLogLevel(r.URL.Query().Get("level"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := SetLogLevel(level); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"level": level.String()})
+}
+
+// GET /v1/watch?revision=N, as Server-Sent Events
+// A "snapshot" event with the live members comes first, followed by every
+// membership event as it happens, with the revision as event id. Given a
+// revision, or a Last-Event-ID header, the events after it are replayed
+// instead of the snapshot, as long as they are still kept
+func httpWatch(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("Streaming not supported"))
+		return
+	}
+	var sub *Subscription
+	since := r.URL.Query().Get("revision")
+	if since == "" {
+		since = r.Header.Get("Last-Event-ID")
+	}
+	if since != "" {
+		revision, err := strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		sub, _ = Events.Subscribe(WatchBufferSize, &revision)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if sub == nil {
+		members, revision, snapshotSub := CurrentList.Watch(WatchBufferSize)
+		sub = snapshotSub
+		infos := make([]MemberInfo, 0, len(members))
+		for _, m := range members {
+			infos = append(infos, memberInfo(m))
+		}
+		writeEvent(w, revision, "snapshot", watchSnapshot{revision, infos})
+	}
+	defer Events.Unsubscribe(sub)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(WatchKeepPeriod)
+	defer keepalive.Stop()
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				// Fell behind, the client resumes from its last event id
+				return
+			}
+			writeEvent(w, event.Revision, event.Type, event)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-daemonCtx.Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// POST /v1/event/<name>?coalesce=true, with the payload as body
+func httpUserEvent(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/v1/event/")
+	payload, err := io.ReadAll(io.LimitReader(r.Body, MaxUserEventSize+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	coalesce := r.URL.Query().Get("coalesce") == "true"
+	if err := SendUserEvent(name, payload, coalesce); err != nil {
+		code := http.StatusBadRequest
+		if err == errNotJoined {
+			code = http.StatusConflict
+		}
+		writeError(w, code, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"name": name})
+}
+
+// GET /v1/events, the user events received from now on as Server-Sent
+// Events, with their LTime as event id
+func httpUserEvents(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("Streaming not supported"))
+		return
+	}
+	events := UserEvents.Subscribe(WatchBufferSize)
+	defer UserEvents.Unsubscribe(events)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(WatchKeepPeriod)
+	defer keepalive.Stop()
+	for {
+		select {
+		case event := <-events:
+			writeEvent(w, event.LTime, "user", event)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-daemonCtx.Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// POST /v1/query/<name>?tag=role=db&node=regex&state=alive&timeout=5s&ack=true
+// with the payload as body. The acks and responses are streamed as
+// Server-Sent Events "ack" and "response", then "done" at the deadline
+func httpQuery(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("Streaming not supported"))
+		return
+	}
+	values := r.URL.Query()
+	tags, err := ParseTags(values["tag"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	param := QueryParam{Tags: tags, Node: values.Get("node"), Ack: values.Get("ack") == "true"}
+	if s := values.Get("state"); s != "" {
+		param.States = strings.Split(s, ",")
+	}
+	if s := values.Get("timeout"); s != "" {
+		if param.Timeout, err = time.ParseDuration(s); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	payload, err := io.ReadAll(io.LimitReader(r.Body, MaxQuerySize+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	result, err := Query(strings.TrimPrefix(r.URL.Path, "/v1/query/"), payload, param)
+	if err != nil {
+		code := http.StatusBadRequest
+		if err == errNotJoined {
+			code = http.StatusConflict
+		}
+		writeError(w, code, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	acks, responses := result.Acks, result.Responses
+	count := uint64(0)
+	for acks != nil || responses != nil {
+		select {
+		case from, ok := <-acks:
+			if !ok {
+				acks = nil
+				continue
+			}
+			count += 1
+			writeEvent(w, count, "ack", map[string]string{"from": from})
+		case response, ok := <-responses:
+			if !ok {
+				responses = nil
+				continue
+			}
+			count += 1
+			writeEvent(w, count, "response", response)
+		case <-r.Context().Done():
+			return
+		case <-daemonCtx.Done():
+			return
+		}
+		flusher.Flush()
+	}
+	writeEvent(w, count+1, "done", map[string]uint64{"id": result.ID})
+	flusher.Flush()
+}
+
+func writeEvent(w http.ResponseWriter, id uint64, event string, v interface{}) {
+	data, _ := json.Marshal(v)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, event, data)
+}
+
+// GET /v1/ring, the members of the hash ring and their virtual nodes
+func httpRing(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"replicas": Conf.RingReplicas,
+		"members":  CurrentRing.Members(),
+	})
+}
+
+// GET /v1/ring/owners?key=k&n=3, the members owning the key, primary first
+func httpRingOwners(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	key := r.URL.Query().Get("key")
+	n := 0
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"key":    key,
+		"hash":   ringHash(key),
+		"owners": CurrentRing.Owners(key, n),
+	})
+}
+
+// GET /v1/ring/watch, the ring changes from now on as Server-Sent
+// Events, with the revision of the membership event as event id
+func httpRingWatch(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("Streaming not supported"))
+		return
+	}
+	changes := CurrentRing.Subscribe(WatchBufferSize)
+	defer CurrentRing.Unsubscribe(changes)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(WatchKeepPeriod)
+	defer keepalive.Stop()
+	for {
+		select {
+		case change := <-changes:
+			writeEvent(w, change.Revision, "change", change)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-daemonCtx.Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// GET /v1/leader, the elected leader, 404 if there is none
+func httpLeader(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	leader, ok, err := Leader()
+	if err != nil {
+		writeError(w, http.StatusNotImplemented, err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("No leader"))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"leader": leader, "is_self": isSelf(&leader)})
+}
+
+// GET /v1/leader/watch, the leader changes from now on as Server-Sent
+// Events, with the revision of the membership event as event id
+func httpLeaderWatch(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if CurrentElection == nil {
+		writeError(w, http.StatusNotImplemented, errNoElection)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("Streaming not supported"))
+		return
+	}
+	changes := CurrentElection.Subscribe(WatchBufferSize)
+	defer CurrentElection.Unsubscribe(changes)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(WatchKeepPeriod)
+	defer keepalive.Stop()
+	for {
+		select {
+		case change := <-changes:
+			writeEvent(w, change.Revision, "leader", change)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-daemonCtx.Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// GET /metrics, in the Prometheus text format
+func httpMetrics(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+}
@@ -1,46 +1,317 @@
 package main
 
 import (
-	"log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Logger struct
+type LogLevel int32
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+// Return the level named s, such as "info"
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelInfo, errors.New("Invalid log level " + s)
+}
+
+// A key and value attached to a log entry
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{key, value}
+}
+
+// Leveled, structured logger. Only the tests of this package replace
+// the default one, SSMS is a main package which cannot be imported. If
+// the logger implements SetLevel(LogLevel) the level is adjustable at
+// runtime, if it implements io.Closer it is closed on shutdown
+type LeveledLogger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+}
+
+// Default logger, writes JSON or logfmt lines to a file, stderr or syslog
 type ssmsLogger struct {
-	infoLogger  *log.Logger
-	debugLogger *log.Logger
-	errorLogger *log.Logger
+	level  int32
+	json   bool
+	id     string
+	mu     sync.Mutex
+	out    io.Writer
+	syslog *syslog.Writer
+	closed bool
+}
+
+// Return a new logger with identity str id, configured by Conf
+// Output is Conf.LogOutput: a file path, "stderr" or "syslog"
+func NewSsmsLogger(id string) (*ssmsLogger, error) {
+	level, err := ParseLogLevel(Conf.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	if Conf.LogFormat != "json" && Conf.LogFormat != "logfmt" {
+		return nil, errors.New("Invalid log format " + Conf.LogFormat)
+	}
+	mylogger := ssmsLogger{level: int32(level), json: Conf.LogFormat == "json", id: id}
+
+	switch Conf.LogOutput {
+	case "stderr":
+		mylogger.out = os.Stderr
+	case "syslog":
+		mylogger.syslog, err = syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "ssms")
+		if err != nil {
+			return nil, err
+		}
+	default:
+		mylogger.out, err = newRotatingFile(Conf.LogOutput, Conf.LogMaxSize*1024*1024, Conf.LogMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &mylogger, nil
+}
+
+func (sl *ssmsLogger) SetLevel(level LogLevel) {
+	atomic.StoreInt32(&sl.level, int32(level))
+}
+
+func (sl *ssmsLogger) Level() LogLevel {
+	return LogLevel(atomic.LoadInt32(&sl.level))
+}
+
+func (sl *ssmsLogger) Debug(msg string, fields ...Field) {
+	sl.log(LevelDebug, msg, fields)
+}
+
+func (sl *ssmsLogger) Info(msg string, fields ...Field) {
+	sl.log(LevelInfo, msg, fields)
 }
 
-// Return a new logger with argument filepath and identity str
-func NewSsmsLogger(id string) *ssmsLogger {
-	mylogger := ssmsLogger{}
-	file, _ := os.OpenFile("./ssms.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0766)
-	commonPrefix := "**" + id + "** "
-	prefix := "[INFO]: "
-	mylogger.infoLogger = log.New(file, prefix+commonPrefix, log.Ldate|log.Lmicroseconds)
-	prefix = "[DEBUG]: "
-	mylogger.debugLogger = log.New(file, prefix+commonPrefix, log.Ldate|log.Lmicroseconds)
-	prefix = "[ERROR]: "
-	mylogger.errorLogger = log.New(file, prefix+commonPrefix, log.Ldate|log.Lmicroseconds)
-	return &mylogger
+func (sl *ssmsLogger) Warn(msg string, fields ...Field) {
+	sl.log(LevelWarn, msg, fields)
 }
 
-func (sl *ssmsLogger) Info(s string, args ...interface{}) {
-	sl.infoLogger.Printf(s, args...)
+func (sl *ssmsLogger) Error(msg string, fields ...Field) {
+	sl.log(LevelError, msg, fields)
 }
 
-func (sl *ssmsLogger) Debug(s string, args ...interface{}) {
-	sl.debugLogger.Printf(s, args...)
+func (sl *ssmsLogger) log(level LogLevel, msg string, fields []Field) {
+	if level < sl.Level() {
+		return
+	}
+	all := make([]Field, 0, len(fields)+4)
+	if sl.syslog == nil {
+		// syslog stamps time itself
+		all = append(all, F("ts", time.Now().Format(time.RFC3339Nano)))
+	}
+	all = append(all, F("level", level.String()), F("node", sl.id), F("msg", msg))
+	all = append(all, fields...)
+
+	var line string
+	if sl.json {
+		line = encodeJSON(all)
+	} else {
+		line = encodeLogfmt(all)
+	}
+
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	// Timer callbacks may still log after shutdown
+	if sl.closed {
+		return
+	}
+	if sl.syslog != nil {
+		switch level {
+		case LevelDebug:
+			sl.syslog.Debug(line)
+		case LevelInfo:
+			sl.syslog.Info(line)
+		case LevelWarn:
+			sl.syslog.Warning(line)
+		default:
+			sl.syslog.Err(line)
+		}
+		return
+	}
+	io.WriteString(sl.out, line+"\n")
+}
+
+// Flush and close the log output, the lines logged afterwards are dropped
+func (sl *ssmsLogger) Close() error {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if sl.closed {
+		return nil
+	}
+	sl.closed = true
+	if sl.syslog != nil {
+		return sl.syslog.Close()
+	}
+	if file, ok := sl.out.(*rotatingFile); ok {
+		return file.Close()
+	}
+	return nil
 }
 
-func (sl *ssmsLogger) Error(s string, args ...interface{}) {
-	sl.errorLogger.Printf(s, args...)
+func encodeJSON(fields []Field) string {
+	var b strings.Builder
+	b.WriteString("{")
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		key, _ := json.Marshal(f.Key)
+		value, err := json.Marshal(fieldValue(f.Value))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(f.Value))
+		}
+		b.Write(key)
+		b.WriteString(":")
+		b.Write(value)
+	}
+	b.WriteString("}")
+	return b.String()
 }
 
-//func main() {
-//logger := NewSsmsLogger("10.0.0.1")
-//for s := 0; s < 1000; s += 1 {
-//logger.Debug("How about you\n")
-//}
-/*}*/
+func encodeLogfmt(fields []Field) string {
+	var b strings.Builder
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(f.Key)
+		b.WriteString("=")
+		value := fmt.Sprint(fieldValue(f.Value))
+		if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(value)
+	}
+	return b.String()
+}
+
+// Errors are logged as their message
+func fieldValue(v interface{}) interface{} {
+	if err, ok := v.(error); ok {
+		return err.Error()
+	}
+	return v
+}
+
+// Log file rotated once it would exceed maxSize bytes,
+// keeping maxBackups old files named path.1, path.2, ...
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Shift path.N to path.N+1, dropping the oldest, and start a new file
+func (rf *rotatingFile) rotate() error {
+	rf.file.Close()
+	if rf.maxBackups < 1 {
+		os.Remove(rf.path)
+	} else {
+		os.Remove(rf.backup(rf.maxBackups))
+		for n := rf.maxBackups - 1; n > 0; n-- {
+			os.Rename(rf.backup(n), rf.backup(n+1))
+		}
+		os.Rename(rf.path, rf.backup(1))
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) backup(n int) string {
+	return rf.path + "." + strconv.Itoa(n)
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.file.Sync()
+	return rf.file.Close()
+}
+
+// Change the level of Logger at runtime
+func SetLogLevel(level LogLevel) error {
+	leveled, ok := Logger.(interface{ SetLevel(LogLevel) })
+	if !ok {
+		return errors.New("Logger does not support changing the level")
+	}
+	leveled.SetLevel(level)
+	Logger.Info("Log level changed", F("level", level.String()))
+	return nil
+}
+
+// Close Logger if it supports it
+func closeLogger() {
+	if closer, ok := Logger.(io.Closer); ok {
+		closer.Close()
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoggerClosed(t *testing.T) {
+	saved := Conf
+	defer func() { Conf = saved }()
+	path := filepath.Join(t.TempDir(), "ssms.log")
+	Conf.LogLevel, Conf.LogFormat, Conf.LogOutput = "info", "logfmt", path
+	logger, err := NewSsmsLogger("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("Before close")
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("After close")
+	if err := logger.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "Before close") || strings.Contains(string(data), "After close") {
+		t.Errorf("log file %q, want only the line logged before closing", data)
+	}
+}
@@ -4,46 +4,95 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"sync"
+	"time"
 )
 
+// Every method is safe for concurrent use.
+// Changes are published to Events while the list is locked
 type MemberList struct {
+	mu          sync.RWMutex
 	Members     []*Member
 	size        int
 	curPos      int
 	shuffleList []int
+	tombstones  []*Tombstone
 }
 
 type Member struct {
 	TimeStamp uint64
 	IP        uint32
 	State     uint8
+	Meta      *Metadata
+}
+
+// Return the readable name of the state bitfield
+func stateName(state uint8) string {
+	switch {
+	case state&StateLeft != 0:
+		return "left"
+	case state&StateDead != 0:
+		return "dead"
+	case state&StateSuspect != 0:
+		return "suspect"
+	case state&StateAlive != 0:
+		return "alive"
+	}
+	return "unknown"
+}
+
+// A dead or left member, remembered until ReclaimAt so that
+// stale updates cannot resurrect it
+type Tombstone struct {
+	Member    Member
+	ReclaimAt time.Time
 }
 
 func NewMemberList(capacity int) *MemberList {
 	ml := MemberList{}
 	ml.Members = make([]*Member, capacity)
-	Logger.Info("Member list created\n")
+	Logger.Debug("Member list created")
 	return &ml
 }
 
+// Drop every member and tombstone, without publishing events
+func (ml *MemberList) Reset(capacity int) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	ml.Members = make([]*Member, capacity)
+	ml.size = 0
+	ml.curPos = 0
+	ml.shuffleList = nil
+	ml.tombstones = nil
+	Logger.Debug("Member list cleared")
+}
+
 func (ml *MemberList) Size() int {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
 	return ml.size
 }
 
-// Return the member if exists, otherwise return error
+// Return a copy of the member if exists, otherwise return error
 func (ml *MemberList) Retrieve(ts uint64, ip uint32) (*Member, error) {
-	idx := ml.Select(ts, ip)
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
+	idx := ml.selectLocked(ts, ip)
 	if idx > -1 {
-		return ml.Members[idx], nil
+		member := *ml.Members[idx]
+		return &member, nil
 	} else {
 		return nil, errors.New("Invalid retrieve ts and ip")
 	}
 }
 
-// Return the member if exists, otherwise return error
+// Return a copy of the member if exists, otherwise return error
 func (ml *MemberList) RetrieveByIdx(idx int) (*Member, error) {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
 	if idx < ml.size && idx > -1 {
-		return ml.Members[idx], nil
+		member := *ml.Members[idx]
+		return &member, nil
 	} else {
 		return nil, errors.New("Invalid retrieve index")
 	}
@@ -51,30 +100,68 @@ func (ml *MemberList) RetrieveByIdx(idx int) (*Member, error) {
 
 // If insert member exists, return err
 func (ml *MemberList) Insert(m *Member) error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	return ml.insertLocked(m)
+}
+
+// Insert a member found alive after it was declared failed, dropping
+// its tombstone. A member which left the group is not inserted back
+func (ml *MemberList) Resurrect(m *Member) error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	if ml.selectLocked(m.TimeStamp, m.IP) != -1 {
+		return errors.New("Member already exists")
+	}
+	ml.reclaimTombstones()
+	for i, t := range ml.tombstones {
+		if (t.Member.TimeStamp == m.TimeStamp) && (t.Member.IP == m.IP) {
+			if t.Member.State == StateLeft {
+				return errors.New("Member left")
+			}
+			ml.tombstones = append(ml.tombstones[:i], ml.tombstones[i+1:]...)
+			break
+		}
+	}
+	return ml.insertLocked(m)
+}
+
+func (ml *MemberList) insertLocked(m *Member) error {
 	// Check whether insert member exists
-	if ml.Select(m.TimeStamp, m.IP) != -1 {
+	if ml.selectLocked(m.TimeStamp, m.IP) != -1 {
 		return errors.New("Member already exists")
 	}
 
 	// Resize when needed
 	if ml.size == len(ml.Members) {
-		ml.Resize(ml.size * 2)
+		ml.resizeLocked(ml.size * 2)
 	}
 	// Insert new member
 	ml.Members[ml.size] = m
 	ml.size += 1
+	Events.Publish(EventJoin, *m)
 	// Log Insert
-	Logger.Info("Insert member (%d, %d)\n", m.TimeStamp, m.IP)
+	Logger.Info("Insert member", F("member", int2ip(m.IP).String()), F("ts", m.TimeStamp))
 
 	// Prolong the shuffle list
 	ml.shuffleList = append(ml.shuffleList, len(ml.shuffleList))
-	Logger.Info("Prolong the length of shuffleList to: %d\n", len(ml.shuffleList))
+	Logger.Debug("Prolong shuffle list", F("length", len(ml.shuffleList)))
 	return nil
 }
 
 // If delete member doesn't exist, return error
 func (ml *MemberList) Delete(ts uint64, ip uint32) error {
-	idx := ml.Select(ts, ip)
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	idx := ml.selectLocked(ts, ip)
+	if idx > -1 {
+		Events.Publish(EventLeave, *ml.Members[idx])
+	}
+	return ml.deleteLocked(ts, ip)
+}
+
+func (ml *MemberList) deleteLocked(ts uint64, ip uint32) error {
+	idx := ml.selectLocked(ts, ip)
 	if idx > -1 {
 		// Shorten the shuffle list
 		// Find the index of the maximum value in the shuffleList
@@ -92,12 +179,12 @@ func (ml *MemberList) Delete(ts uint64, ip uint32) error {
 		} else {
 			ml.curPos %= len(ml.shuffleList)
 		}
-		Logger.Info("Shorten the length of shuffleList to: %d\n", len(ml.shuffleList))
+		Logger.Debug("Shorten shuffle list", F("length", len(ml.shuffleList)))
 
 		// Replace the delete member with the last member
 		ml.Members[idx] = ml.Members[ml.size-1]
 		ml.size -= 1
-		Logger.Info("Delete member (%d, %d)\n", ts, ip)
+		Logger.Info("Delete member", F("member", int2ip(ip).String()), F("ts", ts))
 		return nil
 	} else {
 		return errors.New("Invalid delete")
@@ -106,17 +193,200 @@ func (ml *MemberList) Delete(ts uint64, ip uint32) error {
 
 // If update member doesn't exist, return error
 func (ml *MemberList) Update(ts uint64, ip uint32, state uint8) error {
-	idx := ml.Select(ts, ip)
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	idx := ml.selectLocked(ts, ip)
 	if idx > -1 {
+		old := ml.Members[idx].State
 		ml.Members[idx].State = state
-		Logger.Info("Update member (%d, %d) to state: %b\n", ts, ip, state)
+		eventType := EventUpdate
+		if state&StateSuspect != 0 && old&StateSuspect == 0 {
+			eventType = EventSuspect
+		} else if state&StateSuspect == 0 && old&StateSuspect != 0 {
+			eventType = EventResume
+		}
+		Events.Publish(eventType, *ml.Members[idx])
+		Logger.Info("Update member", F("member", int2ip(ip).String()), F("ts", ts), F("state", stateName(state)))
 		return nil
 	} else {
 		return errors.New("Invalid update")
 	}
 }
 
+// Replace the health bits of the member state
+func (ml *MemberList) SetHealth(ts uint64, ip uint32, health uint8) error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	idx := ml.selectLocked(ts, ip)
+	if idx == -1 {
+		return errors.New("Invalid set health")
+	}
+	m := ml.Members[idx]
+	if m.State&HealthMask == health {
+		return nil
+	}
+	m.State = m.State&^HealthMask | health
+	Events.Publish(EventUpdate, *m)
+	Logger.Info("Update member health", F("member", int2ip(ip).String()), F("ts", ts), F("health", healthName(health)))
+	return nil
+}
+
+// Replace the metadata of the member, unless it is not newer
+func (ml *MemberList) SetMetadata(ts uint64, ip uint32, meta *Metadata) error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	idx := ml.selectLocked(ts, ip)
+	if idx == -1 {
+		return errors.New("Invalid set metadata")
+	}
+	m := ml.Members[idx]
+	if meta.version() <= m.Meta.version() {
+		return nil
+	}
+	m.Meta = meta
+	Events.Publish(EventUpdate, *m)
+	Logger.Info("Update member tags", F("member", int2ip(ip).String()), F("ts", ts), F("tags", m.Tags().String()))
+	return nil
+}
+
+// Remove the member from the list and keep a tombstone with state
+// StateDead or StateLeft for Conf.TombstonePeriod.
+// A failure is only recorded for a member in the list, a leave is always
+// recorded, so that a straggling join cannot add the member afterwards
+func (ml *MemberList) MarkDead(ts uint64, ip uint32, state uint8) error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	idx := ml.selectLocked(ts, ip)
+	if idx == -1 && state == StateDead {
+		return errors.New("Invalid mark dead")
+	}
+	var meta *Metadata
+	if idx > -1 {
+		meta = ml.Members[idx].Meta
+		ml.deleteLocked(ts, ip)
+	}
+
+	ml.reclaimTombstones()
+	tombstone := &Tombstone{Member{ts, ip, state, meta}, time.Now().Add(Conf.TombstonePeriod)}
+	changed := true
+	found := false
+	for i, t := range ml.tombstones {
+		if (t.Member.TimeStamp == ts) && (t.Member.IP == ip) {
+			changed = t.Member.State != state
+			if meta == nil {
+				tombstone.Member.Meta = t.Member.Meta
+			}
+			ml.tombstones[i] = tombstone
+			found = true
+		}
+	}
+	if !found {
+		ml.tombstones = append(ml.tombstones, tombstone)
+	}
+	if idx > -1 || changed {
+		if state == StateDead {
+			Events.Publish(EventFailed, tombstone.Member)
+		} else {
+			Events.Publish(EventLeave, tombstone.Member)
+		}
+		Logger.Info("Tombstone member", F("member", int2ip(ip).String()), F("ts", ts), F("state", stateName(state)))
+	}
+	return nil
+}
+
+// Return ture if the member is dead or left and not yet reclaimed
+func (ml *MemberList) IsTombstoned(ts uint64, ip uint32) bool {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	ml.reclaimTombstones()
+	for _, t := range ml.tombstones {
+		if (t.Member.TimeStamp == ts) && (t.Member.IP == ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the timestamp of the latest identity of ip declared failed,
+// unless a member with ip is in the list again
+func (ml *MemberList) FailedTimeStamp(ip uint32) (uint64, bool) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	for idx := 0; idx < ml.size; idx += 1 {
+		if ml.Members[idx].IP == ip {
+			return 0, false
+		}
+	}
+	ml.reclaimTombstones()
+	var ts uint64
+	found := false
+	for _, t := range ml.tombstones {
+		if t.Member.IP == ip && t.Member.State == StateDead && t.Member.TimeStamp >= ts {
+			ts = t.Member.TimeStamp
+			found = true
+		}
+	}
+	return ts, found
+}
+
+// Drop tombstones whose reclaim period elapsed
+func (ml *MemberList) reclaimTombstones() {
+	now := time.Now()
+	kept := ml.tombstones[:0]
+	for _, t := range ml.tombstones {
+		if now.Before(t.ReclaimAt) {
+			kept = append(kept, t)
+		} else {
+			Logger.Info("Reclaim tombstone", F("member", int2ip(t.Member.IP).String()), F("ts", t.Member.TimeStamp))
+		}
+	}
+	ml.tombstones = kept
+}
+
+// Return a copy of the live members
+func (ml *MemberList) Snapshot() []Member {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
+	members := make([]Member, ml.size)
+	for idx := 0; idx < ml.size; idx += 1 {
+		members[idx] = *ml.Members[idx]
+	}
+	return members
+}
+
+// Return a copy of the tombstones not yet reclaimed
+func (ml *MemberList) Tombstones() []Tombstone {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	ml.reclaimTombstones()
+	tombstones := make([]Tombstone, len(ml.tombstones))
+	for idx, t := range ml.tombstones {
+		tombstones[idx] = *t
+	}
+	return tombstones
+}
+
+// Return a copy of the live members and the revision of the last event
+// they reflect, with a subscription to the events after that revision
+func (ml *MemberList) Watch(size int) ([]Member, uint64, *Subscription) {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
+	members := make([]Member, ml.size)
+	for idx := 0; idx < ml.size; idx += 1 {
+		members[idx] = *ml.Members[idx]
+	}
+	revision := Events.Revision()
+	sub, _ := Events.Subscribe(size, nil)
+	return members, revision, sub
+}
+
 func (ml *MemberList) Select(ts uint64, ip uint32) int {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
+	return ml.selectLocked(ts, ip)
+}
+
+func (ml *MemberList) selectLocked(ts uint64, ip uint32) int {
 	for idx := 0; idx < ml.size; idx += 1 {
 		if (ml.Members[idx].TimeStamp == ts) && (ml.Members[idx].IP == ip) {
 			// Search hit
@@ -128,6 +398,12 @@ func (ml *MemberList) Select(ts uint64, ip uint32) int {
 }
 
 func (ml *MemberList) Resize(capacity int) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	ml.resizeLocked(capacity)
+}
+
+func (ml *MemberList) resizeLocked(capacity int) {
 	members := make([]*Member, capacity)
 	// Copy arrays
 	for idx := 0; idx < ml.size; idx += 1 {
@@ -136,22 +412,43 @@ func (ml *MemberList) Resize(capacity int) {
 	ml.Members = members
 }
 
-func (ml *MemberList) PrintMemberList() {
+// Print the live members, and the tombstones as well if all is set
+func (ml *MemberList) PrintMemberList(all bool) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
 	fmt.Printf("------------------------------------------\n")
 	fmt.Printf("Size: %d\n", ml.size)
 	for idx := 0; idx < ml.size; idx += 1 {
 		m := ml.Members[idx]
-		fmt.Printf("idx: %d, TS: %d, IP: %s, ST: %b\n", idx,
+		fmt.Printf("idx: %d, TS: %d, IP: %s, ST: %b", idx,
 			m.TimeStamp, int2ip(m.IP).String(), m.State)
+		if len(m.Tags()) > 0 {
+			fmt.Printf(", Tags: %s", m.Tags())
+		}
+		fmt.Printf("\n")
+	}
+	if all {
+		ml.reclaimTombstones()
+		fmt.Printf("Tombstones: %d\n", len(ml.tombstones))
+		for idx, t := range ml.tombstones {
+			fmt.Printf("idx: %d, TS: %d, IP: %s, ST: %b, Reclaim: %s\n", idx,
+				t.Member.TimeStamp, int2ip(t.Member.IP).String(), t.Member.State,
+				t.ReclaimAt.Format("15:04:05"))
+		}
 	}
 	fmt.Printf("------------------------------------------\n")
 }
 
-// Return an round-robin random member
+// Return a copy of an round-robin random member, nil if the list is empty
 func (ml *MemberList) Shuffle() *Member {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	if len(ml.shuffleList) == 0 {
+		return nil
+	}
 	// Shuffle the shuffleList when the curPos comes to the end
 	if ml.curPos == (len(ml.shuffleList) - 1) {
-		member := ml.Members[ml.shuffleList[ml.curPos]]
+		member := *ml.Members[ml.shuffleList[ml.curPos]]
 		ml.curPos = (ml.curPos + 1) % len(ml.shuffleList)
 		// // Shuffle the shuffleList
 		// rand.Shuffle(len(ml.shuffleList), func(i, j int) {
@@ -162,16 +459,18 @@ func (ml *MemberList) Shuffle() *Member {
 			j := rand.Intn(i + 1)
 			ml.shuffleList[i], ml.shuffleList[j] = ml.shuffleList[j], ml.shuffleList[i]
 		}
-		return member
+		return &member
 	} else {
-		member := ml.Members[ml.shuffleList[ml.curPos]]
+		member := *ml.Members[ml.shuffleList[ml.curPos]]
 		ml.curPos = (ml.curPos + 1) % len(ml.shuffleList)
-		return member
+		return &member
 	}
 }
 
 // Return ture if IP exists in the list
 func (ml *MemberList) ContainsIP(ip uint32) bool {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
 	for idx := 0; idx < ml.size; idx += 1 {
 		if ml.Members[idx].IP == ip {
 			return true
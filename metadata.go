@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Key/value tags a member advertises, such as role=db or zone=us-east
+type Tags map[string]string
+
+// Tags of a member with the version they were set at by the member.
+// Never modified once created, a newer Metadata replaces it
+type Metadata struct {
+	Version uint64
+	Tags    Tags
+}
+
+// Return the version, 0 for no metadata
+func (meta *Metadata) version() uint64 {
+	if meta == nil {
+		return 0
+	}
+	return meta.Version
+}
+
+// Return the tags, nil for no metadata
+func (m *Member) Tags() Tags {
+	if m.Meta == nil {
+		return nil
+	}
+	return m.Meta.Tags
+}
+
+// Format as key=value pairs sorted by key, joined by commas
+func (t Tags) String() string {
+	pairs := make([]string, 0, len(t))
+	for _, key := range t.keys() {
+		pairs = append(pairs, key+"="+t[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Add a key=value pair, so that Tags can be set by repeated flags
+func (t *Tags) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return errors.New("Invalid tag " + s + ", expect key=value")
+	}
+	if *t == nil {
+		*t = make(Tags)
+	}
+	(*t)[key] = value
+	return nil
+}
+
+func (t Tags) keys() []string {
+	keys := make([]string, 0, len(t))
+	for key := range t {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Return true if t has every tag of filter with the same value
+func (t Tags) Match(filter Tags) bool {
+	for key, value := range filter {
+		if v, ok := t[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse key=value pairs
+func ParseTags(pairs []string) (Tags, error) {
+	tags := make(Tags)
+	for _, pair := range pairs {
+		if err := tags.Set(pair); err != nil {
+			return nil, err
+		}
+	}
+	return tags, nil
+}
+
+// Check the tags fit in MaxMetadataSize once encoded
+func (t Tags) validate() error {
+	if len(t) > 0xff {
+		return errors.New("Too many tags")
+	}
+	size := 9
+	for key, value := range t {
+		if key == "" || strings.Contains(key, "=") {
+			return errors.New("Invalid tag key " + key)
+		}
+		if len(key) > 0xff || len(value) > 0xff {
+			return errors.New("Tag " + key + " is too long")
+		}
+		size += 2 + len(key) + len(value)
+	}
+	if size > MaxMetadataSize {
+		return errors.New("Tags exceed the metadata size limit")
+	}
+	return nil
+}
+
+// Replace the tags of this node and gossip them if it is in the group
+func SetTags(tags Tags) error {
+	if err := tags.validate(); err != nil {
+		return err
+	}
+	controlMutex.Lock()
+	defer controlMutex.Unlock()
+	copied := make(Tags, len(tags))
+	for key, value := range tags {
+		copied[key] = value
+	}
+	self := *getCurrentMember()
+	// Versions only grow, even if the clock goes back
+	version := uint64(time.Now().UnixNano())
+	if version <= self.Meta.version() {
+		version = self.Meta.version() + 1
+	}
+	meta := &Metadata{version, copied}
+
+	CurrentList.SetMetadata(self.TimeStamp, self.IP, meta)
+	self.Meta = meta
+	setCurrentMember(&self)
+	Logger.Info("Set tags", F("tags", copied.String()), F("version", version))
+	if isJoined() {
+		addUpdate2Cache(&self, MemUpdateMeta)
+	}
+	return nil
+}
+
+// Handle a metadata update, the member advertises new tags
+func handleMeta(update *Update) {
+	meta, err := readMetadata(bytes.NewReader(update.Payload))
+	if err != nil {
+		printError(err)
+		return
+	}
+	CurrentList.SetMetadata(update.MemberTimeStamp, update.MemberIP, meta)
+}
+
+// Write the metadata as its version followed by its tags
+func writeMetadata(buf *bytes.Buffer, meta *Metadata) {
+	binary.Write(buf, binary.BigEndian, meta.version())
+	tags := Tags(nil)
+	if meta != nil {
+		tags = meta.Tags
+	}
+	writeTags(buf, tags)
+}
+
+// Write the number of tags, and each tag as a
+// length prefixed key and value, sorted by key
+func writeTags(buf *bytes.Buffer, tags Tags) {
+	buf.WriteByte(uint8(len(tags)))
+	for _, key := range tags.keys() {
+		buf.WriteByte(uint8(len(key)))
+		buf.WriteString(key)
+		buf.WriteByte(uint8(len(tags[key])))
+		buf.WriteString(tags[key])
+	}
+}
+
+func encodeMetadata(meta *Metadata) []byte {
+	var buf bytes.Buffer
+	writeMetadata(&buf, meta)
+	return buf.Bytes()
+}
+
+// Read metadata written by writeMetadata, nil if it has no version
+func readMetadata(r *bytes.Reader) (*Metadata, error) {
+	var version uint64
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return nil, err
+	}
+	tags, err := readTags(r)
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 {
+		return nil, nil
+	}
+	return &Metadata{version, tags}, nil
+}
+
+func readTags(r *bytes.Reader) (Tags, error) {
+	count, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	tags := make(Tags, count)
+	for i := 0; i < int(count); i++ {
+		key, err := readShortString(r)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readShortString(r)
+		if err != nil {
+			return nil, err
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+// Read a string prefixed by its one byte length
+func readShortString(r *bytes.Reader) (string, error) {
+	length, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Read bytes prefixed by their two bytes length
+func readLongBytes(r *bytes.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
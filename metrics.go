@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Monotonic counter, safe for concurrent use
+type Counter struct {
+	value uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// Counters partitioned by the value of a single label
+type CounterVec struct {
+	mu       sync.Mutex
+	counters map[string]*Counter
+}
+
+// Return the counter of the label value, created on first use
+func (v *CounterVec) With(label string) *Counter {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.counters == nil {
+		v.counters = make(map[string]*Counter)
+	}
+	c, ok := v.counters[label]
+	if !ok {
+		c = &Counter{}
+		v.counters[label] = c
+	}
+	return c
+}
+
+// Return the label values in order, with their counter values
+func (v *CounterVec) snapshot() ([]string, []uint64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	labels := make([]string, 0, len(v.counters))
+	for label := range v.counters {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	values := make([]uint64, len(labels))
+	for i, label := range labels {
+		values[i] = v.counters[label].Value()
+	}
+	return labels, values
+}
+
+// Cumulative histogram with fixed upper bounds
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i] += 1
+		}
+	}
+	h.sum += v
+	h.count += 1
+}
+
+// Outbound traffic
+var PacketsSent CounterVec
+var BytesSent CounterVec
+var SendErrors Counter
+
+// Inbound traffic
+var PacketsReceived CounterVec
+var BytesReceived CounterVec
+var PacketsMalformed Counter
+var PacketsMismatched Counter
+
+// Traffic dropped by the rate limits, by direction
+var PacketsThrottled CounterVec
+var BytesThrottled CounterVec
+
+// Failure detector
+var ProbesSent Counter
+var AcksReceived Counter
+var ProbeTimeouts Counter
+var ProbeRTT = NewHistogram([]float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1})
+var SuspicionsRaised Counter
+var SuspicionsRefuted Counter
+var FailuresDetected CounterVec
+
+// Dissemination
+var UpdatesEnqueued Counter
+var UpdatesExpired Counter
+var DuplicateUpdates Counter
+
+// User events
+var UserEventsSent Counter
+var UserEventsDelivered Counter
+var UserEventsCoalesced Counter
+
+// Queries
+var QueriesSent Counter
+var QueriesReceived Counter
+var QueryResponses Counter
+
+// Event handlers
+var HandlerRuns CounterVec
+
+// Health checks
+var HealthChecksRun CounterVec
+var HealthChanges Counter
+
+// Partition healing
+var ReconnectAttempts Counter
+var PartitionHeals Counter
+var MembersHealed Counter
+
+// Rejoins of this node under a new identity
+var Readmissions Counter
+
+// Leader election
+var LeaderChanges Counter
+
+// Webhooks
+var WebhookEvents CounterVec
+var WebhookRetries Counter
+
+// Write every metric in the Prometheus text exposition format
+func writeMetrics(w io.Writer) {
+	writeCounterVec(w, "ssms_packets_sent_total", "Packets sent by message type.", "type", &PacketsSent)
+	writeCounterVec(w, "ssms_bytes_sent_total", "Bytes sent by message type.", "type", &BytesSent)
+	writeCounter(w, "ssms_send_errors_total", "Packets which could not be sent.", &SendErrors)
+	writeCounterVec(w, "ssms_packets_received_total", "Packets received by message type.", "type", &PacketsReceived)
+	writeCounterVec(w, "ssms_bytes_received_total", "Bytes received by message type.", "type", &BytesReceived)
+	writeCounter(w, "ssms_packets_malformed_total", "Packets dropped for being shorter than a header.", &PacketsMalformed)
+	writeCounter(w, "ssms_packets_version_mismatch_total", "Packets dropped for another wire version.", &PacketsMismatched)
+	writeCounterVec(w, "ssms_packets_throttled_total", "Packets dropped by the rate limits by direction, in or out.", "direction", &PacketsThrottled)
+	writeCounterVec(w, "ssms_bytes_throttled_total", "Bytes dropped by the rate limits by direction, in or out.", "direction", &BytesThrottled)
+
+	writeCounter(w, "ssms_probes_sent_total", "Pings sent.", &ProbesSent)
+	writeCounter(w, "ssms_acks_received_total", "Acks received for outstanding pings.", &AcksReceived)
+	writeCounter(w, "ssms_probe_timeouts_total", "Pings not acked in time.", &ProbeTimeouts)
+	writeCounterVec(w, "ssms_tcp_probes_total", "TCP probes sent after a ping timeout by result, ok or failed.", "result", &TCPProbes)
+	writeCounter(w, "ssms_udp_blocked_total", "Pings timed out while the member acked a TCP probe.", &UDPBlocked)
+	writeHistogram(w, "ssms_probe_rtt_seconds", "Round trip time of acked pings.", ProbeRTT)
+	writeCounter(w, "ssms_suspicions_raised_total", "Members suspected by this node.", &SuspicionsRaised)
+	writeCounter(w, "ssms_suspicions_refuted_total", "Suspicions cancelled by a resume update.", &SuspicionsRefuted)
+	writeCounterVec(w, "ssms_failures_detected_total", "Members declared failed, detected by self or others.", "by", &FailuresDetected)
+
+	writeCounter(w, "ssms_updates_enqueued_total", "Updates set in the TTL cache.", &UpdatesEnqueued)
+	writeCounter(w, "ssms_updates_expired_total", "Updates expired from the TTL cache.", &UpdatesExpired)
+	writeCounter(w, "ssms_duplicate_updates_dropped_total", "Updates dropped as duplicated.", &DuplicateUpdates)
+
+	writeCounter(w, "ssms_user_events_sent_total", "User events broadcast by this node.", &UserEventsSent)
+	writeCounter(w, "ssms_user_events_delivered_total", "User events delivered to subscribers.", &UserEventsDelivered)
+	writeCounter(w, "ssms_user_events_coalesced_total", "User events superseded by a later one of the same name.", &UserEventsCoalesced)
+
+	writeCounter(w, "ssms_queries_sent_total", "Queries sent by this node.", &QueriesSent)
+	writeCounter(w, "ssms_queries_received_total", "Queries passing the filters of this node.", &QueriesReceived)
+	writeCounter(w, "ssms_query_responses_total", "Responses received for the queries of this node.", &QueryResponses)
+
+	writeCounterVec(w, "ssms_event_handler_runs_total", "Event handler runs by result, ok, failed, timeout or dropped.", "result", &HandlerRuns)
+	writeCounterVec(w, "ssms_webhook_events_total", "Membership events posted to webhooks by result, ok, failed or dropped.", "result", &WebhookEvents)
+	writeCounter(w, "ssms_webhook_retries_total", "Webhook requests retried.", &WebhookRetries)
+
+	writeCounterVec(w, "ssms_health_checks_total", "Health checks run by result, healthy, degraded or unhealthy.", "result", &HealthChecksRun)
+	writeCounter(w, "ssms_health_changes_total", "Changes of the health advertised by this node.", &HealthChanges)
+	fmt.Fprintf(w, "# HELP ssms_health Health of this node, 0 healthy, 1 degraded, 2 unhealthy.\n# TYPE ssms_health gauge\nssms_health %d\n", getCurrentMember().State&HealthMask>>6)
+
+	writeCounter(w, "ssms_reconnect_attempts_total", "Failed members contacted again to heal a partition.", &ReconnectAttempts)
+	writeCounter(w, "ssms_partition_heals_total", "State merges which brought failed members back.", &PartitionHeals)
+	writeCounter(w, "ssms_members_healed_total", "Failed members brought back by a state merge of this node.", &MembersHealed)
+	writeCounter(w, "ssms_readmissions_total", "Rejoins of this node under a new identity after it was declared failed.", &Readmissions)
+
+	writeCounter(w, "ssms_leader_changes_total", "Leaders elected by this node, none included.", &LeaderChanges)
+	if leader, ok, err := Leader(); err == nil {
+		isLeader := 0
+		if ok && isSelf(&leader) {
+			isLeader = 1
+		}
+		fmt.Fprintf(w, "# HELP ssms_leader Whether this node is the leader.\n# TYPE ssms_leader gauge\nssms_leader %d\n", isLeader)
+	}
+
+	writeCounterVec(w, "ssms_dns_queries_total", "DNS queries answered by record type.", "type", &DNSQueries)
+
+	counts := make(map[string]int)
+	for _, m := range CurrentList.Snapshot() {
+		counts[stateName(m.State)] += 1
+	}
+	for _, t := range CurrentList.Tombstones() {
+		counts[stateName(t.Member.State)] += 1
+	}
+	fmt.Fprintf(w, "# HELP ssms_members Members known by this node by state.\n# TYPE ssms_members gauge\n")
+	for _, state := range []string{"alive", "suspect", "dead", "left"} {
+		fmt.Fprintf(w, "ssms_members{state=%q} %d\n", state, counts[state])
+	}
+}
+
+func writeCounter(w io.Writer, name string, help string, c *Counter) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, c.Value())
+}
+
+func writeCounterVec(w io.Writer, name string, help string, label string, v *CounterVec) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	labels, values := v.snapshot()
+	for i := range labels {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, labels[i], values[i])
+	}
+}
+
+func writeHistogram(w io.Writer, name string, help string, h *Histogram) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, formatFloat(bound), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", name, formatFloat(h.sum), name, h.count)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
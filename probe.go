@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Interval between the probe rounds of periodicPing, in nanoseconds
+var probeInterval int64
+
+// Return the interval between probe rounds for a list of members.
+// With Conf.ProbeTarget, every other member is probed within it: a round
+// probes Conf.ProbeFanout of them, so all the rounds of a pass over the
+// list must fit in the target. Small groups are probed less often, large
+// ones no more often than every MinProbeInterval
+func nextProbeInterval(members int) (time.Duration, bool) {
+	if Conf.ProbeTarget <= 0 {
+		return Conf.ProbeInterval, true
+	}
+	rounds := (members - 1 + probeFanout() - 1) / probeFanout()
+	if rounds < 1 {
+		return Conf.ProbeTarget, true
+	}
+	interval := Conf.ProbeTarget / time.Duration(rounds)
+	if interval < MinProbeInterval {
+		return MinProbeInterval, false
+	}
+	return interval, true
+}
+
+// Return the number of members probed every round, at least 1
+func probeFanout() int {
+	if Conf.ProbeFanout < 1 {
+		return 1
+	}
+	return Conf.ProbeFanout
+}
+
+// Choose the probe interval for the current list, log it when it changes
+func updateProbeInterval() time.Duration {
+	members := CurrentList.Size()
+	interval, met := nextProbeInterval(members)
+	if previous := time.Duration(atomic.SwapInt64(&probeInterval, int64(interval))); previous != interval {
+		fields := []Field{F("interval", interval.String()), F("fanout", probeFanout()), F("members", members)}
+		if met {
+			Logger.Info("Probe interval", fields...)
+		} else {
+			Logger.Warn("Probe target cannot be met, raise the fanout", append(fields, F("target", Conf.ProbeTarget.String()))...)
+		}
+	}
+	return interval
+}
+
+// Return the current interval between probe rounds
+func ProbeInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&probeInterval))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextProbeInterval(t *testing.T) {
+	saved := Conf
+	defer func() { Conf = saved }()
+	tests := []struct {
+		name     string
+		interval time.Duration
+		target   time.Duration
+		fanout   int
+		members  int
+		want     time.Duration
+		wantMet  bool
+	}{
+		{"fixed interval", 250 * time.Millisecond, 0, 1, 100, 250 * time.Millisecond, true},
+		{"alone", 0, 5 * time.Second, 1, 1, 5 * time.Second, true},
+		{"not joined", 0, 5 * time.Second, 1, 0, 5 * time.Second, true},
+		{"two members", 0, 5 * time.Second, 1, 2, 5 * time.Second, true},
+		{"small group", 0, 5 * time.Second, 1, 3, 2500 * time.Millisecond, true},
+		{"one round per member", 0, 5 * time.Second, 1, 11, 500 * time.Millisecond, true},
+		{"fanout rounds up", 0, 5 * time.Second, 2, 4, 2500 * time.Millisecond, true},
+		{"fanout over the members", 0, 5 * time.Second, 8, 4, 5 * time.Second, true},
+		{"fanout below 1", 0, 5 * time.Second, 0, 11, 500 * time.Millisecond, true},
+		{"at the minimum", 0, 5 * time.Second, 1, 101, MinProbeInterval, true},
+		{"target not met", 0, 5 * time.Second, 1, 1000, MinProbeInterval, false},
+	}
+	for _, tt := range tests {
+		Conf.ProbeInterval, Conf.ProbeTarget, Conf.ProbeFanout = tt.interval, tt.target, tt.fanout
+		got, met := nextProbeInterval(tt.members)
+		if got != tt.want || met != tt.wantMet {
+			t.Errorf("%s: nextProbeInterval(%d) = %s, %t, want %s, %t", tt.name, tt.members, got, met, tt.want, tt.wantMet)
+		}
+	}
+}
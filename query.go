@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of direct messages, sent in the Reserved header field
+const (
+	DirectQueryAck      = 0x01
+	DirectQueryResponse = 0x02
+	DirectPushPull      = 0x03
+	DirectPushPullReply = 0x04
+)
+
+// Filters and timeout of a query. Members must have every tag, an IP
+// matching Node as a whole, and be in one of States both as seen by
+// themselves and by the originator
+type QueryParam struct {
+	Tags    Tags
+	Node    string
+	States  []string
+	Timeout time.Duration
+	Ack     bool
+}
+
+// A query as received by a handler
+type QueryRequest struct {
+	ID       uint64
+	Name     string
+	Payload  []byte
+	From     string
+	Deadline time.Time
+}
+
+// Answer a query, the returned payload is sent back to the originator.
+// A nil payload with no error sends no response
+type QueryHandler func(query *QueryRequest) ([]byte, error)
+
+// The response of a member to a query
+type NodeResponse struct {
+	From      string    `json:"from"`
+	TimeStamp uint64    `json:"timestamp"`
+	Payload   []byte    `json:"payload"`
+	Time      time.Time `json:"time"`
+}
+
+// Acks and responses of a query, both closed at the deadline
+type QueryResult struct {
+	ID        uint64
+	Deadline  time.Time
+	Acks      <-chan string
+	Responses <-chan NodeResponse
+}
+
+// A query of this node waiting for its deadline
+type pendingQuery struct {
+	param     QueryParam
+	acks      chan string
+	responses chan NodeResponse
+	acked     map[uint32]bool
+	responded map[uint32]bool
+}
+
+var queryHandlers = make(map[string]QueryHandler)
+var pendingQueries = make(map[uint64]*pendingQuery)
+
+// mutex used for queryHandlers and pendingQueries
+var queryMutex sync.Mutex
+
+func init() {
+	// Built in, answers with the node info
+	RegisterQueryHandler("info", func(query *QueryRequest) ([]byte, error) {
+		return json.Marshal(selfInfo())
+	})
+}
+
+// Register the handler of the queries named name, replacing any
+func RegisterQueryHandler(name string, handler QueryHandler) {
+	queryMutex.Lock()
+	defer queryMutex.Unlock()
+	queryHandlers[name] = handler
+}
+
+// Gossip a query to the group. The members passing the filters ack it
+// if requested, and answer it with their handler directly to this node
+// until the deadline. This node answers its own queries as well
+func Query(name string, payload []byte, param QueryParam) (*QueryResult, error) {
+	if name == "" || len(name) > 0xff || len(param.Node) > 0xff {
+		return nil, errors.New("Invalid query name or node filter")
+	}
+	if len(payload) > MaxQuerySize {
+		return nil, errors.New("Query payload exceeds the size limit")
+	}
+	if _, err := regexp.Compile(anchorPattern(param.Node)); err != nil {
+		return nil, err
+	}
+	if err := param.Tags.validate(); err != nil {
+		return nil, err
+	}
+	for _, state := range param.States {
+		if state != "alive" && state != "suspect" {
+			return nil, errors.New("Invalid query state filter " + state)
+		}
+	}
+	if !isJoined() {
+		return nil, errNotJoined
+	}
+	if param.Timeout <= 0 {
+		param.Timeout = QueryTimeoutPeriod
+	}
+
+	id := TTLCaches.NewID()
+	deadline := time.Now().Add(param.Timeout)
+	size := 2*CurrentList.Size() + WatchBufferSize
+	pending := &pendingQuery{
+		param:     param,
+		acks:      make(chan string, size),
+		responses: make(chan NodeResponse, size),
+		acked:     make(map[uint32]bool),
+		responded: make(map[uint32]bool),
+	}
+	queryMutex.Lock()
+	pendingQueries[id] = pending
+	queryMutex.Unlock()
+	// Not an afterTimer, Shutdown closes the query if it comes first
+	time.AfterFunc(param.Timeout, func() { closeQuery(id) })
+
+	query := QueryRequest{id, name, payload, LocalIP, deadline}
+	self := getCurrentMember()
+	update := Update{id, TTL_, MemUpdateQuery, self.TimeStamp, self.IP, self.State, encodeQuery(&query, &param)}
+	TTLCaches.Set(&update)
+	isUpdateDuplicate(id)
+	QueriesSent.Inc()
+	Logger.Info("Query", F("name", name), F("query_id", id), F("timeout", param.Timeout.String()))
+
+	runQuery(&query, &param, getCurrentMember().IP)
+	return &QueryResult{id, deadline, pending.acks, pending.responses}, nil
+}
+
+// Close the channels of the pending query and forget it, once
+func closeQuery(id uint64) {
+	queryMutex.Lock()
+	defer queryMutex.Unlock()
+	if pending, ok := pendingQueries[id]; ok {
+		delete(pendingQueries, id)
+		close(pending.acks)
+		close(pending.responses)
+	}
+}
+
+// Close every pending query, so that no caller waits past shutdown
+func closeQueries() {
+	queryMutex.Lock()
+	ids := make([]uint64, 0, len(pendingQueries))
+	for id := range pendingQueries {
+		ids = append(ids, id)
+	}
+	queryMutex.Unlock()
+	for _, id := range ids {
+		closeQuery(id)
+	}
+}
+
+// Wait for the deadline, return the acks and responses received
+func (r *QueryResult) Collect() ([]string, []NodeResponse) {
+	acks := make([]string, 0)
+	responses := make([]NodeResponse, 0)
+	ackCh, responseCh := r.Acks, r.Responses
+	for ackCh != nil || responseCh != nil {
+		select {
+		case from, ok := <-ackCh:
+			if !ok {
+				ackCh = nil
+				continue
+			}
+			acks = append(acks, from)
+		case response, ok := <-responseCh:
+			if !ok {
+				responseCh = nil
+				continue
+			}
+			responses = append(responses, response)
+		}
+	}
+	return acks, responses
+}
+
+// Parse the query command of the console, send the query and print
+// its acks and responses as they come in, without blocking the console
+func consoleQuery(args []string) error {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	fs.SetOutput(os.Stdout)
+	var param QueryParam
+	fs.Var(&param.Tags, "tag", "only members with the key=value tag, repeatable")
+	fs.StringVar(&param.Node, "node", "", "only members whose IP matches the regex")
+	states := fs.String("state", "", "only members in these comma separated states")
+	fs.DurationVar(&param.Timeout, "timeout", QueryTimeoutPeriod, "how long to wait for responses")
+	fs.BoolVar(&param.Ack, "ack", false, "ask the members to ack the query")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New("Usage: query [--tag k=v] [--node regex] [--state alive] [--timeout 5s] [--ack] <name> [payload]")
+	}
+	if *states != "" {
+		param.States = strings.Split(*states, ",")
+	}
+	result, err := Query(fs.Arg(0), []byte(strings.Join(fs.Args()[1:], " ")), param)
+	if err != nil {
+		return err
+	}
+	goDaemon(func() {
+		acks, responses := result.Acks, result.Responses
+		count := 0
+		for acks != nil || responses != nil {
+			select {
+			case from, ok := <-acks:
+				if !ok {
+					acks = nil
+					continue
+				}
+				fmt.Printf("Ack from %s\n", from)
+			case response, ok := <-responses:
+				if !ok {
+					responses = nil
+					continue
+				}
+				count += 1
+				fmt.Printf("Response from %s: %s\n", response.From, response.Payload)
+			}
+		}
+		fmt.Printf("Query %d done, %d responses\n", result.ID, count)
+	})
+	return nil
+}
+
+// Handle a query update from another member
+func handleQuery(update *Update) {
+	query, param, err := decodeQuery(update.Payload)
+	if err != nil {
+		printError(err)
+		return
+	}
+	query.ID = update.UpdateID
+	query.From = int2ip(update.MemberIP).String()
+	if time.Now().After(query.Deadline) {
+		Logger.Debug("Ignore expired query", F("name", query.Name), F("query_id", query.ID))
+		return
+	}
+	runQuery(&query, &param, update.MemberIP)
+}
+
+// Ack and answer the query if this node passes its filters
+func runQuery(query *QueryRequest, param *QueryParam, origin uint32) {
+	if !getCurrentMember().Tags().Match(param.Tags) {
+		return
+	}
+	if matched, _ := regexp.MatchString(anchorPattern(param.Node), LocalIP); !matched {
+		return
+	}
+	// The handler only runs on the members in the states asked for,
+	// the originator checks them again with its own view
+	if !queryStateMatch(param.States, getCurrentMember()) {
+		return
+	}
+	QueriesReceived.Inc()
+	if param.Ack {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, query.ID)
+		self := getCurrentMember()
+		writeMember(&buf, &Member{self.TimeStamp, self.IP, self.State, nil})
+		sendDirect(origin, DirectQueryAck, buf.Bytes())
+	}
+
+	queryMutex.Lock()
+	handler, ok := queryHandlers[query.Name]
+	queryMutex.Unlock()
+	if !ok {
+		return
+	}
+	goDaemon(func() {
+		payload, err := handler(query)
+		if err != nil {
+			Logger.Warn("Query handler failed", F("name", query.Name), F("query_id", query.ID), F("err", err))
+			return
+		}
+		if payload == nil || time.Now().After(query.Deadline) {
+			return
+		}
+		if len(payload) > MaxResponseSize {
+			Logger.Warn("Query response exceeds the size limit", F("name", query.Name), F("query_id", query.ID), F("size", len(payload)))
+			return
+		}
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, query.ID)
+		self := getCurrentMember()
+		writeMember(&buf, &Member{self.TimeStamp, self.IP, self.State, nil})
+		binary.Write(&buf, binary.BigEndian, uint16(len(payload)))
+		buf.Write(payload)
+		sendDirect(origin, DirectQueryResponse, buf.Bytes())
+	})
+}
+
+// Send a message to a member outside of the probing, its header
+// has both Ping and Ack set and kind in the Reserved field
+func sendDirect(ip uint32, kind uint8, payload []byte) {
+	var binBuffer bytes.Buffer
+	binary.Write(&binBuffer, binary.BigEndian, Header{WireVersion, Ping | Ack, 0, kind})
+	binBuffer.Write(payload)
+	if ip == getCurrentMember().IP {
+		// Own query, skip the network
+		handleDirect(kind, binBuffer.Bytes()[4:])
+		return
+	}
+	udpSend(int2ip(ip).String()+Port, binBuffer.Bytes())
+}
+
+// Handle a direct message by its kind
+func handleDirect(kind uint8, payload []byte) {
+	switch kind {
+	case DirectQueryAck, DirectQueryResponse:
+		handleQueryReply(kind, payload)
+	case DirectPushPull, DirectPushPullReply:
+		handlePushPull(kind, payload)
+	default:
+		Logger.Debug("Ignore direct message of unknown kind", F("kind", kind))
+	}
+}
+
+// Deliver an ack or a response to the pending query, once per member
+func handleQueryReply(kind uint8, payload []byte) {
+	buf := bytes.NewReader(payload)
+	var id uint64
+	if err := binary.Read(buf, binary.BigEndian, &id); err != nil {
+		printError(err)
+		return
+	}
+	member, err := readMember(buf)
+	if err != nil {
+		printError(err)
+		return
+	}
+	var data []byte
+	if kind == DirectQueryResponse {
+		if data, err = readLongBytes(buf); err != nil {
+			printError(err)
+			return
+		}
+	}
+
+	queryMutex.Lock()
+	defer queryMutex.Unlock()
+	pending, ok := pendingQueries[id]
+	if !ok {
+		Logger.Debug("Ignore reply of unknown or expired query", F("query_id", id), F("member", int2ip(member.IP).String()))
+		return
+	}
+	if !queryStateMatch(pending.param.States, &member) {
+		return
+	}
+	from := int2ip(member.IP).String()
+	if kind == DirectQueryAck && !pending.acked[member.IP] {
+		pending.acked[member.IP] = true
+		select {
+		case pending.acks <- from:
+		default:
+		}
+	} else if kind == DirectQueryResponse && !pending.responded[member.IP] {
+		pending.responded[member.IP] = true
+		QueryResponses.Inc()
+		select {
+		case pending.responses <- NodeResponse{from, member.TimeStamp, data, time.Now().UTC()}:
+		default:
+		}
+	}
+}
+
+// Match the node filter against a whole IP, so that 10.0.0.1 does
+// not match 110.0.0.12. An empty filter matches every IP
+func anchorPattern(node string) string {
+	if node == "" {
+		return ""
+	}
+	return "^(?:" + node + ")$"
+}
+
+// Return true if this node sees the member in one of states, or states is empty
+// This node is alive unless its list says otherwise
+func queryStateMatch(states []string, member *Member) bool {
+	if len(states) == 0 {
+		return true
+	}
+	state := "alive"
+	if known, err := CurrentList.Retrieve(member.TimeStamp, member.IP); err == nil {
+		state = stateName(known.State)
+	} else if !isCurrentMember(member.TimeStamp, member.IP) {
+		return false
+	}
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// Encode as the deadline, an ack flag, the length prefixed name and
+// node filter, the tag filter, the state filter and the payload
+func encodeQuery(query *QueryRequest, param *QueryParam) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, query.Deadline.UnixNano())
+	if param.Ack {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	buf.WriteByte(uint8(len(query.Name)))
+	buf.WriteString(query.Name)
+	buf.WriteByte(uint8(len(param.Node)))
+	buf.WriteString(param.Node)
+	writeTags(&buf, param.Tags)
+	// The receivers apply the state filter to themselves, the
+	// originator to the members replying
+	states := uint8(0)
+	for _, state := range param.States {
+		if state == "alive" {
+			states |= StateAlive
+		} else if state == "suspect" {
+			states |= StateSuspect
+		}
+	}
+	buf.WriteByte(states)
+	binary.Write(&buf, binary.BigEndian, uint16(len(query.Payload)))
+	buf.Write(query.Payload)
+	return buf.Bytes()
+}
+
+func decodeQuery(data []byte) (QueryRequest, QueryParam, error) {
+	var query QueryRequest
+	var param QueryParam
+	buf := bytes.NewReader(data)
+	var deadline int64
+	if err := binary.Read(buf, binary.BigEndian, &deadline); err != nil {
+		return query, param, err
+	}
+	query.Deadline = time.Unix(0, deadline)
+	flags, err := buf.ReadByte()
+	if err != nil {
+		return query, param, err
+	}
+	param.Ack = flags&1 != 0
+	if query.Name, err = readShortString(buf); err != nil {
+		return query, param, err
+	}
+	if param.Node, err = readShortString(buf); err != nil {
+		return query, param, err
+	}
+	if param.Tags, err = readTags(buf); err != nil {
+		return query, param, err
+	}
+	states, err := buf.ReadByte()
+	if err != nil {
+		return query, param, err
+	}
+	if states&StateAlive != 0 {
+		param.States = append(param.States, "alive")
+	}
+	if states&StateSuspect != 0 {
+		param.States = append(param.States, "suspect")
+	}
+	query.Payload, err = readLongBytes(buf)
+	return query, param, err
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestQueryNodeFilter(t *testing.T) {
+	tests := []struct {
+		node string
+		ip   string
+		want bool
+	}{
+		{"", "10.0.0.1", true},
+		{"10.0.0.1", "10.0.0.1", true},
+		{"10.0.0.1", "110.0.0.12", false},
+		{"10.0.0.1", "10.0.0.12", false},
+		{`10\.0\.0\.\d+`, "10.0.0.12", true},
+		{"10.0.0.1|10.0.0.2", "10.0.0.2", true},
+		{"10.0.0.1|10.0.0.2", "10.0.0.21", false},
+	}
+	for _, tt := range tests {
+		matched, err := regexp.MatchString(anchorPattern(tt.node), tt.ip)
+		if err != nil || matched != tt.want {
+			t.Errorf("node %q against %s = %t, %v, want %t", tt.node, tt.ip, matched, err, tt.want)
+		}
+	}
+}
+
+func TestQueryStateFilter(t *testing.T) {
+	self := setupNode(t, "10.0.0.1", 1)
+	suspect := Member{2, testIP("10.0.0.2"), StateSuspect, nil}
+	CurrentList.Insert(&suspect)
+	tests := []struct {
+		states []string
+		member *Member
+		want   bool
+	}{
+		{nil, self, true},
+		{[]string{"alive"}, self, true},
+		{[]string{"suspect"}, self, false},
+		{[]string{"suspect"}, &suspect, true},
+		{[]string{"alive"}, &suspect, false},
+		{[]string{"alive"}, &Member{3, testIP("10.0.0.3"), StateAlive, nil}, false},
+	}
+	for _, tt := range tests {
+		if got := queryStateMatch(tt.states, tt.member); got != tt.want {
+			t.Errorf("states %v for %s = %t, want %t", tt.states, int2ip(tt.member.IP), got, tt.want)
+		}
+	}
+	// A suspected node runs no handler for alive members only
+	CurrentList.Update(self.TimeStamp, self.IP, StateSuspect)
+	if queryStateMatch([]string{"alive"}, getCurrentMember()) {
+		t.Error("suspected node matches the alive filter")
+	}
+}
+
+func TestShutdownClosesQueries(t *testing.T) {
+	setupNode(t, "10.0.0.1", 1)
+	result, err := Query("unknown", nil, QueryParam{Timeout: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Waits like the console does, tracked by daemonWg
+	done := make(chan struct{})
+	goDaemon(func() {
+		result.Collect()
+		close(done)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown with a query in flight: %v", err)
+	}
+	select {
+	case <-done:
+	default:
+		t.Error("Collect still waiting after Shutdown")
+	}
+	queryMutex.Lock()
+	defer queryMutex.Unlock()
+	if len(pendingQueries) != 0 {
+		t.Errorf("%d pending queries left", len(pendingQueries))
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Token bucket refilled at rate tokens per second up to burst.
+// A rate of 0 or less is unlimited
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// Last warning of a packet dropped
+	warned time.Time
+}
+
+func newTokenBucket(rate float64, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Refill the tokens for the time elapsed since the last refill
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// Return true if n tokens are available
+func (b *tokenBucket) has(n float64) bool {
+	return b.rate <= 0 || b.tokens >= n
+}
+
+// Outbound budget of Conf.SendPacketRate and Conf.SendByteRate
+var sendPackets, sendBytes *tokenBucket
+var sendMutex sync.Mutex
+
+// Inbound budget of Conf.RecvPacketRate for each source IP
+var recvBuckets = make(map[string]*tokenBucket)
+var recvMutex sync.Mutex
+
+// Return true if a packet of size bytes to addr fits in the outbound
+// budget. A packet over budget is dropped, as if lost on the way
+func allowSend(addr string, size int) bool {
+	if Conf.SendPacketRate <= 0 && Conf.SendByteRate <= 0 {
+		return true
+	}
+	sendMutex.Lock()
+	defer sendMutex.Unlock()
+	if sendPackets == nil {
+		// A second worth of traffic
+		sendPackets = newTokenBucket(Conf.SendPacketRate, math.Max(Conf.SendPacketRate, 1))
+		sendBytes = newTokenBucket(Conf.SendByteRate, math.Max(Conf.SendByteRate, 1))
+	}
+	now := time.Now()
+	sendPackets.refill(now)
+	sendBytes.refill(now)
+	// A packet larger than the burst goes out with a full bucket,
+	// and is paid for afterwards
+	if !sendPackets.has(1) || !sendBytes.has(math.Min(float64(size), sendBytes.burst)) {
+		PacketsThrottled.With("out").Inc()
+		BytesThrottled.With("out").Add(uint64(size))
+		if now.Sub(sendPackets.warned) > ThrottleLogPeriod {
+			sendPackets.warned = now
+			Logger.Warn("Outbound budget exceeded, drop packets", F("member", addr), F("packets_per_sec", Conf.SendPacketRate), F("bytes_per_sec", Conf.SendByteRate))
+		}
+		return false
+	}
+	sendPackets.tokens -= 1
+	sendBytes.tokens -= float64(size)
+	return true
+}
+
+// Return true if a packet of size bytes from ip fits in its inbound budget
+func allowRecv(ip string, size int) bool {
+	if Conf.RecvPacketRate <= 0 {
+		return true
+	}
+	recvMutex.Lock()
+	defer recvMutex.Unlock()
+	now := time.Now()
+	bucket, ok := recvBuckets[ip]
+	if !ok {
+		// Forget the sources idle long enough to have a full bucket
+		if len(recvBuckets) >= MaxRecvSources {
+			for source, b := range recvBuckets {
+				if b.refill(now); b.tokens >= b.burst {
+					delete(recvBuckets, source)
+				}
+			}
+		}
+		bucket = newTokenBucket(Conf.RecvPacketRate, math.Max(Conf.RecvPacketRate, 1))
+		recvBuckets[ip] = bucket
+	}
+	bucket.refill(now)
+	if !bucket.has(1) {
+		PacketsThrottled.With("in").Inc()
+		BytesThrottled.With("in").Add(uint64(size))
+		if now.Sub(bucket.warned) > ThrottleLogPeriod {
+			bucket.warned = now
+			Logger.Warn("Inbound rate exceeded, drop packets", F("member", ip), F("packets_per_sec", Conf.RecvPacketRate))
+		}
+		return false
+	}
+	bucket.tokens -= 1
+	return true
+}
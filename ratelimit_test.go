@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    float64
+		burst   float64
+		tokens  float64
+		elapsed time.Duration
+		n       float64
+		want    bool
+	}{
+		{"full bucket", 10, 10, 10, 0, 10, true},
+		{"empty bucket", 10, 10, 0, 0, 1, false},
+		{"refilled by the elapsed time", 10, 10, 0, 100 * time.Millisecond, 1, true},
+		{"partly refilled", 10, 10, 0, 100 * time.Millisecond, 2, false},
+		{"refill capped at the burst", 10, 10, 0, time.Hour, 11, false},
+		{"debt paid back first", 10, 10, -5, 500 * time.Millisecond, 1, false},
+		{"unlimited", 0, 1, 0, 0, 1000, true},
+	}
+	for _, tt := range tests {
+		now := time.Now()
+		bucket := &tokenBucket{rate: tt.rate, burst: tt.burst, tokens: tt.tokens, last: now}
+		bucket.refill(now.Add(tt.elapsed))
+		if got := bucket.has(tt.n); got != tt.want {
+			t.Errorf("%s: has(%g) with %g tokens = %t, want %t", tt.name, tt.n, bucket.tokens, got, tt.want)
+		}
+	}
+}
+
+// Reset the rate limits and Conf after the test
+func setupRateLimits(t *testing.T) {
+	saved := Conf
+	Logger = discardLogger{}
+	reset := func() {
+		sendMutex.Lock()
+		sendPackets, sendBytes = nil, nil
+		sendMutex.Unlock()
+		recvMutex.Lock()
+		recvBuckets = make(map[string]*tokenBucket)
+		recvMutex.Unlock()
+	}
+	reset()
+	t.Cleanup(func() {
+		Conf = saved
+		reset()
+	})
+}
+
+func TestAllowSend(t *testing.T) {
+	tests := []struct {
+		name        string
+		packetRate  float64
+		byteRate    float64
+		sizes       []int
+		wantAllowed []bool
+	}{
+		{"unlimited", 0, 0, []int{1 << 16, 1 << 16}, []bool{true, true}},
+		{"packet rate", 2, 0, []int{1, 1, 1}, []bool{true, true, false}},
+		{"byte rate", 0, 100, []int{60, 40, 1}, []bool{true, true, false}},
+		{"larger than the burst goes out on a full bucket", 0, 100, []int{500, 1}, []bool{true, false}},
+	}
+	for _, tt := range tests {
+		setupRateLimits(t)
+		Conf.SendPacketRate, Conf.SendByteRate = tt.packetRate, tt.byteRate
+		for i, size := range tt.sizes {
+			if got := allowSend("10.0.0.2:6666", size); got != tt.wantAllowed[i] {
+				t.Errorf("%s: packet %d of %d bytes allowed %t, want %t", tt.name, i, size, got, tt.wantAllowed[i])
+			}
+		}
+	}
+}
+
+func TestAllowRecv(t *testing.T) {
+	setupRateLimits(t)
+	Conf.RecvPacketRate = 2
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.0.0.2", true},
+		{"10.0.0.2", true},
+		{"10.0.0.2", false},
+		// Each source has its own budget
+		{"10.0.0.3", true},
+		{"10.0.0.2", false},
+	}
+	for i, tt := range tests {
+		if got := allowRecv(tt.ip, 100); got != tt.want {
+			t.Errorf("packet %d from %s allowed %t, want %t", i, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestAllowRecvPrunesIdleSources(t *testing.T) {
+	setupRateLimits(t)
+	Conf.RecvPacketRate = 2
+	now := time.Now()
+	recvMutex.Lock()
+	for i := 0; i < MaxRecvSources; i++ {
+		// Idle for long enough to have a full bucket
+		recvBuckets["10.1.0."+strconv.Itoa(i)] = &tokenBucket{rate: 2, burst: 2, last: now.Add(-time.Minute)}
+	}
+	// Still paying for its last packets
+	recvBuckets["10.0.0.2"] = &tokenBucket{rate: 2, burst: 2, last: now}
+	recvMutex.Unlock()
+
+	if !allowRecv("10.0.0.3", 100) {
+		t.Fatal("new source dropped")
+	}
+	recvMutex.Lock()
+	defer recvMutex.Unlock()
+	if len(recvBuckets) != 2 || recvBuckets["10.0.0.2"] == nil || recvBuckets["10.0.0.3"] == nil {
+		t.Errorf("%d sources kept, want the busy and the new one", len(recvBuckets))
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// A point of the ring, one of the virtual nodes of a member
+type ringPoint struct {
+	Hash uint64
+	IP   string
+}
+
+// Keys hashed in (Start, End] moved from the From owners to the To ones.
+// Start > End for the range wrapping around 0, Start == End for the
+// whole ring
+type RingRange struct {
+	Start uint64   `json:"start"`
+	End   uint64   `json:"end"`
+	From  []string `json:"from"`
+	To    []string `json:"to"`
+}
+
+// The ranges moved by a membership event
+type RingChange struct {
+	Revision uint64      `json:"revision"`
+	Type     string      `json:"type"`
+	Member   string      `json:"member"`
+	Moved    []RingRange `json:"moved"`
+}
+
+// A ring member with its number of virtual nodes
+type RingMember struct {
+	IP     string  `json:"ip"`
+	Weight float64 `json:"weight"`
+	VNodes int     `json:"vnodes"`
+}
+
+// Consistent hash ring of the live members, maintained from the
+// membership events. Each member has VNodes virtual nodes times its
+// weight, read from a tag; a weight of 0 keeps it off the ring
+type Ring struct {
+	mu          sync.RWMutex
+	vnodes      int
+	replicas    int
+	weightTag   string
+	members     map[[2]uint64]RingMember
+	points      []ringPoint
+	subscribers map[chan RingChange]bool
+}
+
+// The ring of this node, built by startRing
+var CurrentRing = NewRing(RingVNodes, RingReplicas, "weight")
+
+func NewRing(vnodes int, replicas int, weightTag string) *Ring {
+	return &Ring{
+		vnodes:      vnodes,
+		replicas:    replicas,
+		weightTag:   weightTag,
+		members:     make(map[[2]uint64]RingMember),
+		subscribers: make(map[chan RingChange]bool),
+	}
+}
+
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Return the IPs of the n distinct members owning key, its primary
+// owner first. n of 0 or less is the replication factor of the ring
+func (r *Ring) Owners(key string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if n <= 0 {
+		n = r.replicas
+	}
+	return ownersAt(r.points, ringHash(key), n)
+}
+
+// Return the IPs of the n distinct members whose points follow hash
+func ownersAt(points []ringPoint, hash uint64, n int) []string {
+	owners := make([]string, 0, n)
+	if len(points) == 0 {
+		return owners
+	}
+	start := sort.Search(len(points), func(i int) bool { return points[i].Hash >= hash })
+	for i := 0; i < len(points) && len(owners) < n; i++ {
+		ip := points[(start+i)%len(points)].IP
+		found := false
+		for _, owner := range owners {
+			found = found || owner == ip
+		}
+		if !found {
+			owners = append(owners, ip)
+		}
+	}
+	return owners
+}
+
+// Return the members on the ring, sorted by IP
+func (r *Ring) Members() []RingMember {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	members := make([]RingMember, 0)
+	for _, m := range r.byIP() {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].IP < members[j].IP })
+	return members
+}
+
+// Return the members by IP. An IP may be held by several identities
+// for a while after a restart, it weighs as the heaviest one
+func (r *Ring) byIP() map[string]RingMember {
+	byIP := make(map[string]RingMember)
+	for _, m := range r.members {
+		if prev, ok := byIP[m.IP]; !ok || m.VNodes > prev.VNodes {
+			byIP[m.IP] = m
+		}
+	}
+	return byIP
+}
+
+// Return the weight of a member from its tags, 1 if it has none
+func (r *Ring) weight(info MemberInfo) float64 {
+	value, ok := info.Tags[r.weightTag]
+	if !ok {
+		return 1
+	}
+	weight, err := strconv.ParseFloat(value, 64)
+	if err != nil || weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+		Logger.Warn("Invalid ring weight, use 1", F("member", info.IP), F("weight", value))
+		return 1
+	}
+	return weight
+}
+
+// Apply a membership event, return the ranges it moved
+func (r *Ring) apply(event MemberEvent) []RingRange {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := [2]uint64{event.Member.TimeStamp, uint64(ip2int(net.ParseIP(event.Member.IP)))}
+	switch event.Type {
+	case EventJoin, EventUpdate, EventResume:
+		weight := r.weight(event.Member)
+		r.members[key] = RingMember{event.Member.IP, weight, int(math.Round(weight * float64(r.vnodes)))}
+	case EventFailed, EventLeave:
+		if event.Self && event.Type == EventLeave {
+			// Out of the group, the ring is empty until joining again
+			r.members = make(map[[2]uint64]RingMember)
+		} else {
+			delete(r.members, key)
+		}
+	default:
+		return nil
+	}
+	return r.rebuild()
+}
+
+// Replace the members with the given ones, return the ranges moved
+func (r *Ring) reset(members []Member) []RingRange {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.members = make(map[[2]uint64]RingMember)
+	for _, m := range members {
+		info := memberInfo(m)
+		weight := r.weight(info)
+		r.members[[2]uint64{m.TimeStamp, uint64(m.IP)}] = RingMember{info.IP, weight, int(math.Round(weight * float64(r.vnodes)))}
+	}
+	return r.rebuild()
+}
+
+// Recompute the points from the members, return the moved ranges
+func (r *Ring) rebuild() []RingRange {
+	var points []ringPoint
+	for ip, m := range r.byIP() {
+		for i := 0; i < m.VNodes; i++ {
+			points = append(points, ringPoint{ringHash(ip + "#" + strconv.Itoa(i)), ip})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Hash < points[j].Hash })
+	moved := movedRanges(r.points, points, r.replicas)
+	r.points = points
+	return moved
+}
+
+// Compare the owners of every range between the points of both rings.
+// Keys in (prev, cur] are owned by the members following cur on both
+func movedRanges(before []ringPoint, after []ringPoint, replicas int) []RingRange {
+	bounds := make([]uint64, 0, len(before)+len(after))
+	for _, p := range before {
+		bounds = append(bounds, p.Hash)
+	}
+	for _, p := range after {
+		bounds = append(bounds, p.Hash)
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+
+	var moved []RingRange
+	for i, bound := range bounds {
+		if i > 0 && bound == bounds[i-1] {
+			continue
+		}
+		from, to := ownersAt(before, bound, replicas), ownersAt(after, bound, replicas)
+		if equalStrings(from, to) {
+			continue
+		}
+		start := bounds[(i+len(bounds)-1)%len(bounds)]
+		if n := len(moved); n > 0 && moved[n-1].End == start && equalStrings(moved[n-1].From, from) && equalStrings(moved[n-1].To, to) {
+			moved[n-1].End = bound
+			continue
+		}
+		moved = append(moved, RingRange{start, bound, from, to})
+	}
+	return moved
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Subscribe to the ring changes, a subscriber whose buffer is full
+// misses them
+func (r *Ring) Subscribe(size int) chan RingChange {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ch := make(chan RingChange, size)
+	r.subscribers[ch] = true
+	return ch
+}
+
+func (r *Ring) Unsubscribe(ch chan RingChange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.subscribers[ch] {
+		delete(r.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (r *Ring) publish(change RingChange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	Logger.Info("Ring changed", F("type", change.Type), F("member", change.Member), F("ranges", len(change.Moved)))
+	for ch := range r.subscribers {
+		select {
+		case ch <- change:
+		default:
+			Logger.Warn("Ring subscriber too slow, change dropped", F("revision", change.Revision))
+		}
+	}
+}
+
+// Configure the ring from Conf and keep it up to date
+// with the membership events
+func startRing() {
+	CurrentRing = NewRing(Conf.RingVNodes, Conf.RingReplicas, Conf.RingWeightTag)
+	// Subscribe before the daemon may join
+	sub, _ := Events.Subscribe(WatchBufferSize, nil)
+	goDaemon(func() { maintainRing(CurrentRing, sub) })
+}
+
+func maintainRing(ring *Ring, sub *Subscription) {
+	defer func() { Events.Unsubscribe(sub) }()
+	revision := Events.Revision()
+
+	for {
+		var event MemberEvent
+		var ok bool
+		select {
+		case event, ok = <-sub.C:
+		case <-daemonCtx.Done():
+			return
+		}
+		if !ok {
+			// Fell behind, catch up from the last revision applied
+			var resumed bool
+			sub, resumed = Events.Subscribe(WatchBufferSize, &revision)
+			if !resumed {
+				Logger.Warn("Ring missed membership events", F("revision", revision))
+				sub, _ = Events.Subscribe(WatchBufferSize, nil)
+				revision = Events.Revision()
+				if moved := ring.reset(CurrentList.Snapshot()); len(moved) > 0 {
+					ring.publish(RingChange{revision, "reset", "", moved})
+				}
+			}
+			continue
+		}
+		revision = event.Revision
+		if moved := ring.apply(event); len(moved) > 0 {
+			ring.publish(RingChange{event.Revision, event.Type, event.Member.IP, moved})
+		}
+	}
+}
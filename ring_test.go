@@ -0,0 +1,123 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOwnersAt(t *testing.T) {
+	points := []ringPoint{{10, "a"}, {20, "b"}, {30, "a"}, {40, "c"}}
+	tests := []struct {
+		name   string
+		points []ringPoint
+		hash   uint64
+		n      int
+		want   []string
+	}{
+		{"before the first point", points, 5, 2, []string{"a", "b"}},
+		{"on a point", points, 20, 1, []string{"b"}},
+		{"between points", points, 11, 2, []string{"b", "a"}},
+		{"repeated member skipped", points, 25, 2, []string{"a", "c"}},
+		{"wraps around", points, 41, 2, []string{"a", "b"}},
+		{"more owners than members", points, 0, 5, []string{"a", "b", "c"}},
+		{"no owner asked", points, 0, 0, []string{}},
+		{"empty ring", nil, 0, 3, []string{}},
+	}
+	for _, tt := range tests {
+		if got := ownersAt(tt.points, tt.hash, tt.n); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ownersAt(%d, %d) = %v, want %v", tt.name, tt.hash, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestMovedRanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		before   []ringPoint
+		after    []ringPoint
+		replicas int
+		want     []RingRange
+	}{
+		{"unchanged", []ringPoint{{10, "a"}, {30, "b"}}, []ringPoint{{10, "a"}, {30, "b"}}, 1, nil},
+		{"first member takes the whole ring", nil, []ringPoint{{10, "a"}}, 1,
+			[]RingRange{{10, 10, []string{}, []string{"a"}}}},
+		{"last member leaves the whole ring", []ringPoint{{10, "a"}}, nil, 1,
+			[]RingRange{{10, 10, []string{"a"}, []string{}}}},
+		{"point added", []ringPoint{{10, "a"}, {30, "b"}}, []ringPoint{{10, "a"}, {20, "c"}, {30, "b"}}, 1,
+			[]RingRange{{10, 20, []string{"b"}, []string{"c"}}}},
+		{"point added after the last", []ringPoint{{10, "a"}, {30, "b"}}, []ringPoint{{10, "a"}, {30, "b"}, {40, "c"}}, 1,
+			[]RingRange{{30, 40, []string{"a"}, []string{"c"}}}},
+		{"range wraps around 0", []ringPoint{{10, "a"}, {30, "b"}, {40, "c"}}, []ringPoint{{30, "b"}, {40, "c"}}, 1,
+			[]RingRange{{40, 10, []string{"a"}, []string{"b"}}}},
+		{"adjacent ranges merged", []ringPoint{{10, "a"}, {20, "a"}, {30, "b"}}, []ringPoint{{30, "b"}}, 1,
+			[]RingRange{{30, 20, []string{"a"}, []string{"b"}}}},
+		{"replicas moved", []ringPoint{{10, "a"}, {20, "b"}, {30, "c"}}, []ringPoint{{10, "a"}, {30, "c"}}, 2,
+			[]RingRange{{30, 10, []string{"a", "b"}, []string{"a", "c"}}, {10, 20, []string{"b", "c"}, []string{"c", "a"}}}},
+	}
+	for _, tt := range tests {
+		if got := movedRanges(tt.before, tt.after, tt.replicas); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: movedRanges = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRingWeight(t *testing.T) {
+	Logger = discardLogger{}
+	tests := []struct {
+		weight string
+		vnodes int
+	}{
+		{"", 4},
+		{"0", 0},
+		{"0.5", 2},
+		{"2", 8},
+		{"-1", 4},
+		{"heavy", 4},
+	}
+	for _, tt := range tests {
+		ring := NewRing(4, 1, "weight")
+		tags := Tags{}
+		if tt.weight != "" {
+			tags["weight"] = tt.weight
+		}
+		ring.reset([]Member{
+			{1, testIP("10.0.0.1"), StateAlive, nil},
+			{2, testIP("10.0.0.2"), StateAlive, &Metadata{1, tags}},
+		})
+		members := ring.Members()
+		if len(members) != 2 || members[1].VNodes != tt.vnodes {
+			t.Errorf("weight %q: members %v, want 10.0.0.2 with %d vnodes", tt.weight, members, tt.vnodes)
+		}
+		if tt.vnodes > 0 {
+			continue
+		}
+		// A zero weight keeps the member off the ring
+		for _, key := range []string{"a", "b", "c", "d"} {
+			if owners := ring.Owners(key, 2); !reflect.DeepEqual(owners, []string{"10.0.0.1"}) {
+				t.Errorf("weight 0: owners of %s = %v, want only 10.0.0.1", key, owners)
+			}
+		}
+	}
+}
+
+func TestRingSelfLeave(t *testing.T) {
+	self := setupNode(t, "10.0.0.1", 2)
+	ring := NewRing(4, 1, "weight")
+	ring.reset([]Member{*self, {5, testIP("10.0.0.2"), StateAlive, nil}})
+	tests := []struct {
+		name    string
+		event   MemberEvent
+		members int
+	}{
+		// After a readmission, the old identity of this node leaves
+		{"old identity", MemberEvent{Type: EventLeave, Member: MemberInfo{IP: "10.0.0.1", TimeStamp: 1}}, 2},
+		{"other member", MemberEvent{Type: EventLeave, Member: MemberInfo{IP: "10.0.0.2", TimeStamp: 5}}, 1},
+		{"this node", MemberEvent{Type: EventLeave, Member: MemberInfo{IP: "10.0.0.1", TimeStamp: 2}, Self: true}, 0},
+	}
+	for _, tt := range tests {
+		ring.apply(tt.event)
+		if got := len(ring.Members()); got != tt.members {
+			t.Errorf("%s: %d members left on the ring, want %d", tt.name, got, tt.members)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+#!/bin/bash
+# Pause the daemon of one host for longer than the suspect period, so that
+# the group declares it failed, resume it, and check that every member
+# lists it alive again under a single new identity.
+# Run with the daemons joined and ssmsctl built on every host, go build ./cmd/ssmsctl
+# TestReadmissionAfterPause plays the same over loopback, go test -run Readmission
+#
+# HOSTS    the hosts to check, space separated, required
+# PAUSED   the host to pause, one of HOSTS, required
+# PAUSE    seconds paused, by default 5, past the ping timeout and SuspectPeriod
+# SETTLE   seconds given to the group to readmit it, by default 10
+# SSH_USER the user to ssh as, by default $USER
+# SSMS_DIR the directory of ssms and ssmsctl on the hosts, by default ~/go/src/ssms
+# RUN      command running "$2" in SSMS_DIR on host "$1", by default over ssh
+
+if [ -z "$HOSTS" ] || [ -z "$PAUSED" ]; then
+    echo "Usage: HOSTS=\"host1 host2 ...\" PAUSED=host2 $0"
+    exit 2
+fi
+PAUSE=${PAUSE:-5}
+SETTLE=${SETTLE:-10}
+SSMS_DIR=${SSMS_DIR:-'~/go/src/ssms'}
+
+ssh_run() {
+    ssh ${SSH_USER:-$USER}@$1 "cd $SSMS_DIR; $2"
+}
+RUN=${RUN:-ssh_run}
+
+fail() {
+    echo "FAIL: $*"
+    exit 1
+}
+
+info=$($RUN $PAUSED "./ssmsctl -format json info") || fail "$PAUSED is not running"
+ip=$(echo "$info" | sed -n 's/.*"ip": "\(.*\)".*/\1/p')
+old_ts=$(echo "$info" | sed -n 's/.*"timestamp": \([0-9]*\).*/\1/p')
+echo "Pause $ip, identity $old_ts, for ${PAUSE}s"
+
+$RUN $PAUSED "pkill -STOP -x ssms"
+sleep $PAUSE
+declared=0
+for host in $HOSTS; do
+    [ $host = $PAUSED ] && continue
+    state=$($RUN $host "./ssmsctl members -all" | awk -v ip=$ip -v ts=$old_ts '$1 == ip && $2 == ts {print $3}')
+    [ "$state" = dead ] && declared=$((declared + 1))
+done
+$RUN $PAUSED "pkill -CONT -x ssms"
+[ $declared -gt 0 ] || fail "no member declared $ip failed, pause longer"
+echo "Declared failed by $declared members, resume $ip"
+
+sleep $SETTLE
+new_ts=
+for host in $HOSTS; do
+    alive=$($RUN $host "./ssmsctl members" | awk -v ip=$ip '$1 == ip && $3 == "alive" {print $2}')
+    echo "$host: $ip alive as $alive"
+    [ $(echo $alive | wc -w) -eq 1 ] || fail "$host lists $ip alive $(echo $alive | wc -w) times"
+    [ $alive != $old_ts ] || fail "$host lists the failed identity of $ip alive"
+    [ -z "$new_ts" ] && new_ts=$alive
+    [ $alive = $new_ts ] || fail "$host lists $ip as $alive, others as $new_ts"
+done
+echo "PASS: $ip readmitted as $new_ts"
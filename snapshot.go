@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The members known alive, kept in a file so that a restarted node can
+// rejoin through them. Membership changes are appended as lines such as
+// "alive 172.22.156.97 1538885556887217629" or "dead ...", and a "leave"
+// line once this node left the group. The file is rewritten with only the
+// alive members when it grows past SnapshotMaxLines
+type Snapshot struct {
+	mu    sync.Mutex
+	path  string
+	file  *os.File
+	alive map[[2]uint64]bool
+	left  bool
+	lines int
+}
+
+// The snapshot of Conf.Snapshot, nil if disabled
+var CurrentSnapshot *Snapshot
+
+// Read the snapshot at path, if any, and reopen it for appending
+func OpenSnapshot(path string) (*Snapshot, error) {
+	s := &Snapshot{path: path, alive: make(map[[2]uint64]bool)}
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		// A line cut short by a crash is skipped
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			s.replay(scanner.Text())
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Snapshot) replay(line string) {
+	fields := strings.Fields(line)
+	if len(fields) == 1 && fields[0] == "leave" {
+		s.left = true
+		return
+	}
+	if len(fields) != 3 {
+		return
+	}
+	ip := net.ParseIP(fields[1]).To4()
+	ts, err := strconv.ParseUint(fields[2], 10, 64)
+	if ip == nil || err != nil {
+		return
+	}
+	key := [2]uint64{ts, uint64(ip2int(ip))}
+	switch fields[0] {
+	case "alive":
+		s.alive[key] = true
+		s.left = false
+	case "dead":
+		delete(s.alive, key)
+	}
+}
+
+// Rewrite the file with the alive members only
+func (s *Snapshot) compact() error {
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for key := range s.alive {
+		fmt.Fprintf(w, "alive %s %d\n", int2ip(uint32(key[1])), key[0])
+	}
+	if s.left {
+		fmt.Fprintln(w, "leave")
+	}
+	if err := w.Flush(); err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600)
+	s.lines = len(s.alive)
+	return err
+}
+
+// Apply a membership event and append it to the file
+func (s *Snapshot) record(event MemberEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := [2]uint64{event.Member.TimeStamp, uint64(ip2int(net.ParseIP(event.Member.IP)))}
+	var line string
+	switch event.Type {
+	case EventJoin, EventResume, EventUpdate:
+		if s.alive[key] && !s.left {
+			return
+		}
+		s.alive[key] = true
+		s.left = false
+		line = fmt.Sprintf("alive %s %d", event.Member.IP, event.Member.TimeStamp)
+	case EventFailed, EventLeave:
+		if event.Self && event.Type == EventLeave {
+			// Do not rejoin on restart after leaving on purpose
+			s.left = true
+			line = "leave"
+		} else if s.alive[key] {
+			delete(s.alive, key)
+			line = fmt.Sprintf("dead %s %d", event.Member.IP, event.Member.TimeStamp)
+		}
+	}
+	if line == "" {
+		return
+	}
+	s.append(line)
+}
+
+func (s *Snapshot) append(line string) {
+	if _, err := fmt.Fprintln(s.file, line); err != nil {
+		printError(err)
+	}
+	s.lines += 1
+	if s.lines > SnapshotMaxLines && s.lines > 2*len(s.alive) {
+		if err := s.compact(); err != nil {
+			printError(err)
+		} else {
+			Logger.Debug("Snapshot compacted", F("path", s.path), F("members", len(s.alive)))
+		}
+	}
+}
+
+// Replace the members with the current list
+func (s *Snapshot) reset(members []Member) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.alive = make(map[[2]uint64]bool)
+	for _, m := range members {
+		s.alive[[2]uint64{m.TimeStamp, uint64(m.IP)}] = true
+	}
+	if err := s.compact(); err != nil {
+		printError(err)
+	}
+}
+
+func (s *Snapshot) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// Return the IPs of the other members known alive, shuffled
+func (s *Snapshot) Peers() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[uint64]bool)
+	var peers []string
+	for key := range s.alive {
+		ip := int2ip(uint32(key[1])).String()
+		if seen[key[1]] || ip == LocalIP {
+			continue
+		}
+		seen[key[1]] = true
+		peers = append(peers, ip)
+	}
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	return peers
+}
+
+// Return true if the node was in the group when it stopped
+func (s *Snapshot) ShouldRejoin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.left && len(s.alive) > 0
+}
+
+// Open Conf.Snapshot and record the membership events to it. Return
+// true if the node should rejoin the group it was in before the restart
+func startSnapshot() bool {
+	if Conf.Snapshot == "" {
+		return false
+	}
+	snapshot, err := OpenSnapshot(Conf.Snapshot)
+	if err != nil {
+		printError(err)
+		fmt.Println(err)
+		return false
+	}
+	CurrentSnapshot = snapshot
+	Logger.Info("Snapshot", F("path", Conf.Snapshot), F("peers", len(snapshot.Peers())), F("left", snapshot.left))
+	// Subscribe before the daemon may join
+	sub, _ := Events.Subscribe(WatchBufferSize, nil)
+	goDaemon(func() { recordSnapshot(snapshot, sub) })
+	return snapshot.ShouldRejoin()
+}
+
+func recordSnapshot(snapshot *Snapshot, sub *Subscription) {
+	defer func() { Events.Unsubscribe(sub) }()
+	defer snapshot.Close()
+	revision := Events.Revision()
+
+	for {
+		var event MemberEvent
+		var ok bool
+		select {
+		case event, ok = <-sub.C:
+		case <-daemonCtx.Done():
+			return
+		}
+		if !ok {
+			// Fell behind, catch up from the last revision recorded
+			var resumed bool
+			sub, resumed = Events.Subscribe(WatchBufferSize, &revision)
+			if !resumed {
+				Logger.Warn("Snapshot missed membership events", F("revision", revision))
+				sub, _ = Events.Subscribe(WatchBufferSize, nil)
+				revision = Events.Revision()
+				snapshot.reset(CurrentList.Snapshot())
+			}
+			continue
+		}
+		revision = event.Revision
+		snapshot.record(event)
+	}
+}
+
+// Return the members to send the init request to in turn: those of the
+// snapshot, then the introducer
+func joinContacts() []string {
+	var contacts []string
+	if CurrentSnapshot != nil {
+		contacts = CurrentSnapshot.Peers()
+		if len(contacts) > MaxJoinContacts {
+			contacts = contacts[:MaxJoinContacts]
+		}
+	}
+	for i, contact := range contacts {
+		if contact == IntroducerIP {
+			contacts = append(contacts[:i], contacts[i+1:]...)
+			break
+		}
+	}
+	return append(contacts, IntroducerIP)
+}
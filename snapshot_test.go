@@ -0,0 +1,33 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// Only a leave of the current identity keeps a restart from rejoining,
+// not that of an identity the node had before a readmission
+func TestSnapshotSelfLeave(t *testing.T) {
+	self := setupNode(t, "10.0.0.1", 2)
+	CurrentList.Insert(&Member{1, self.IP, StateAlive, nil})
+	s, err := OpenSnapshot(filepath.Join(t.TempDir(), "snapshot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.file.Close()
+	sub, _ := Events.Subscribe(WatchBufferSize, nil)
+	defer Events.Unsubscribe(sub)
+
+	CurrentList.MarkDead(1, self.IP, StateLeft)
+	s.record(<-sub.C)
+	if s.left {
+		t.Fatal("leave of the old identity recorded as this node leaving")
+	}
+	CurrentList.MarkDead(self.TimeStamp, self.IP, StateLeft)
+	// The node takes a new identity before the event is recorded
+	setCurrentMember(&Member{3, self.IP, StateAlive, nil})
+	s.record(<-sub.C)
+	if !s.left {
+		t.Fatal("leave of this node not recorded")
+	}
+}
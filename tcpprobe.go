@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// The TCP probe listener, nil unless Conf.TCPFallback is set
+var tcpProbeListener net.Listener
+var tcpProbeMutex sync.Mutex
+
+// Probes over TCP by result, ok or failed
+var TCPProbes CounterVec
+
+// Members acking a TCP probe after a UDP ping timed out, logged with
+// their IP, which would make an unbounded label
+var UDPBlocked Counter
+
+// Answer the TCP probes of the members whose UDP pings to this node
+// timed out, on the same port as the UDP socket
+func startTCPProbe(addr string) {
+	if !Conf.TCPFallback {
+		return
+	}
+	listener, err := net.Listen("tcp4", addr)
+	if err != nil {
+		printError(err)
+		fmt.Println(err)
+		return
+	}
+	tcpProbeMutex.Lock()
+	tcpProbeListener = listener
+	tcpProbeMutex.Unlock()
+	Logger.Info("TCP probe listening", F("addr", listener.Addr().String()))
+
+	goDaemon(func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				// The listener is closed on shutdown
+				if daemonCtx.Err() != nil {
+					return
+				}
+				printError(err)
+				continue
+			}
+			goDaemon(func() { serveTCPProbe(conn) })
+		}
+	})
+}
+
+// Close the TCP probe listener
+func stopTCPProbe() {
+	tcpProbeMutex.Lock()
+	defer tcpProbeMutex.Unlock()
+	if tcpProbeListener != nil {
+		tcpProbeListener.Close()
+		tcpProbeListener = nil
+	}
+}
+
+// Ack a single ping header, as the UDP socket would
+func serveTCPProbe(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(TCPProbeTimeout))
+	var header Header
+	if err := binary.Read(conn, binary.BigEndian, &header); err != nil {
+		return
+	}
+	// Once leave, stop responding probes
+	if header.Version != WireVersion || header.Type != Ping || !isJoined() {
+		return
+	}
+	binary.Write(conn, binary.BigEndian, Header{WireVersion, Ack, header.Seq, 0x00})
+}
+
+// Ping member over TCP, return true if it acked in time
+func tcpProbe(member *Member, seq uint16) bool {
+	addr := int2ip(member.IP).String() + Port
+	conn, err := net.DialTimeout("tcp4", addr, TCPProbeTimeout)
+	if err != nil {
+		TCPProbes.With("failed").Inc()
+		Logger.Debug("TCP probe failed", F("member", int2ip(member.IP).String()), F("err", err))
+		return false
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(TCPProbeTimeout))
+
+	var binBuffer bytes.Buffer
+	binary.Write(&binBuffer, binary.BigEndian, Header{WireVersion, Ping, seq, 0x00})
+	var header Header
+	if _, err = conn.Write(binBuffer.Bytes()); err == nil {
+		err = binary.Read(conn, binary.BigEndian, &header)
+	}
+	if err != nil || header.Version != WireVersion || header.Type != Ack || header.Seq != seq {
+		TCPProbes.With("failed").Inc()
+		Logger.Debug("TCP probe failed", F("member", int2ip(member.IP).String()), F("err", err))
+		return false
+	}
+	TCPProbes.With("ok").Inc()
+	return true
+}
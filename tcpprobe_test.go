@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// The TCP probe runs alongside the ping, its result is known when the
+// ping times out
+func TestTCPFallback(t *testing.T) {
+	saved := Conf
+	t.Cleanup(func() { Conf = saved })
+	setupNode(t, "127.0.0.1", 1)
+	Conf.TCPFallback = true
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	UDPConn = conn
+	t.Cleanup(func() {
+		conn.Close()
+		UDPConn = nil
+	})
+	// Only the TCP probe of 127.0.0.2 is answered, no ping is
+	startTCPProbe("127.0.0.2" + Port)
+	t.Cleanup(stopTCPProbe)
+	blocked := Member{2, testIP("127.0.0.2"), StateAlive, nil}
+	down := Member{3, testIP("127.0.0.3"), StateAlive, nil}
+	CurrentList.Insert(&blocked)
+	CurrentList.Insert(&down)
+
+	before := UDPBlocked.Value()
+	sent := time.Now()
+	ping(&blocked)
+	ping(&down)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		// Both timeouts handled
+		timerMutex.Lock()
+		pending := len(PingAckTimeout)
+		timerMutex.Unlock()
+		if pending == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if elapsed := time.Since(sent); elapsed > PingTimeoutPeriod+TCPProbeTimeout/2 {
+		t.Errorf("timeouts handled after %s, want about the ping timeout %s", elapsed, PingTimeoutPeriod)
+	}
+	if got := UDPBlocked.Value() - before; got != 1 {
+		t.Errorf("%d members found with UDP blocked, want 1", got)
+	}
+	if member, _ := CurrentList.Retrieve(down.TimeStamp, down.IP); member.State&StateSuspect == 0 {
+		t.Error("member down over UDP and TCP not suspected")
+	}
+	if member, _ := CurrentList.Retrieve(blocked.TimeStamp, blocked.IP); member.State != StateAlive {
+		t.Errorf("member acking over TCP in state %s, want alive", stateName(member.State))
+	}
+}
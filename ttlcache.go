@@ -4,14 +4,17 @@ import (
 	"errors"
 	//"fmt"
 	"math/rand"
+	"sync"
 	"time"
 )
 
 // TTL Map, type as map[uint64]*Update
+// Safe for concurrent use, mu guards every field
 type TtlCache struct {
+	mu      sync.Mutex
 	TtlList []*Update
 	Pointer int
-	RandGen *rand.Rand
+	randGen *rand.Rand
 }
 
 // Return a new TTL Map
@@ -21,33 +24,54 @@ func NewTtlCache() *TtlCache {
 	randGen := rand.New(randSource)
 	ttllist := make([]*Update, 0)
 
-	Logger.Debug("TTL cache created\n")
-	ttlcache := TtlCache{ttllist, 0, randGen}
-	return &ttlcache
+	Logger.Debug("TTL cache created")
+	return &TtlCache{TtlList: ttllist, randGen: randGen}
+}
+
+// Return a random update ID
+func (tc *TtlCache) NewID() uint64 {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.randGen.Uint64()
+}
+
+// Drop every update in TTL Cache
+func (tc *TtlCache) Reset() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.TtlList = make([]*Update, 0)
+	tc.Pointer = 0
+	Logger.Debug("TTL cache cleared")
 }
 
 // Set the update packet in TTL Cache
 func (tc *TtlCache) Set(val *Update) {
 	if val.TTL < 1 {
-		Logger.Debug("TTL cache cannot set for ttl=0 %d\n", val.UpdateID)
+		Logger.Debug("TTL cache cannot set for ttl=0", F("update_id", val.UpdateID))
 		return
 	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
 	tc.TtlList = append(tc.TtlList, val)
-	Logger.Debug("TTL cache add a new update ID: %d, TTL: %d\n", val.UpdateID, val.TTL)
+	UpdatesEnqueued.Inc()
+	Logger.Debug("TTL cache add a new update", F("update_id", val.UpdateID), F("type", updateName(val.UpdateType)), F("ttl", val.TTL))
 }
 
 // Get one entry each time in TTL Cache
 func (tc *TtlCache) Get() (*Update, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
 	if len(tc.TtlList) == 0 {
-		Logger.Debug("TTL cache empty\n")
+		Logger.Debug("TTL cache empty")
 		return nil, errors.New("Empty TTL List, cannot Get()")
 	}
 	cur := tc.TtlList[tc.Pointer]
 	// Copy current update
-	update := Update{cur.UpdateID, cur.TTL, cur.UpdateType, cur.MemberTimeStamp, cur.MemberIP, cur.MemberState}
+	update := Update{cur.UpdateID, cur.TTL, cur.UpdateType, cur.MemberTimeStamp, cur.MemberIP, cur.MemberState, cur.Payload}
 	cur.TTL -= 1
 	if cur.TTL < 1 {
-		Logger.Debug("TTL cache expired %d\n", cur.UpdateID)
+		Logger.Debug("TTL cache expired", F("update_id", cur.UpdateID))
+		UpdatesExpired.Inc()
 		// Delete this entry
 		copy(tc.TtlList[tc.Pointer:], tc.TtlList[tc.Pointer+1:])
 		tc.TtlList[len(tc.TtlList)-1] = nil
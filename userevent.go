@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An application event broadcast to the group, such as "deploy" with
+// payload "v42". LTime orders events of the same name
+type UserEvent struct {
+	Name     string    `json:"name"`
+	Payload  []byte    `json:"payload"`
+	Coalesce bool      `json:"coalesce"`
+	LTime    uint64    `json:"ltime"`
+	From     string    `json:"from"`
+	Time     time.Time `json:"time"`
+}
+
+// Lamport clock of the user events
+var eventClock uint64
+
+// Delivers user events to subscribers, without blocking. A subscriber
+// whose buffer is full misses the event
+type UserEventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan UserEvent]bool
+}
+
+// User events received by this node, including its own
+var UserEvents = &UserEventBus{subscribers: make(map[chan UserEvent]bool)}
+
+func (b *UserEventBus) Subscribe(size int) chan UserEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan UserEvent, size)
+	b.subscribers[ch] = true
+	return ch
+}
+
+func (b *UserEventBus) Unsubscribe(ch chan UserEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers[ch] {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (b *UserEventBus) Publish(event UserEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	UserEventsDelivered.Inc()
+	Logger.Info("User event", F("name", event.Name), F("ltime", event.LTime), F("from", event.From), F("size", len(event.Payload)))
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			Logger.Warn("User event subscriber too slow, event dropped", F("name", event.Name), F("ltime", event.LTime))
+		}
+	}
+}
+
+// Coalescable events waiting for CoalescePeriod, by name, and the LTime
+// of the last delivered one, kept as long as its duplicates may arrive
+var coalescePending = make(map[string]*UserEvent)
+var coalesceDelivered = make(map[string]uint64)
+var coalesceMutex sync.Mutex
+
+// Broadcast a user event to the group, this node receives it as well.
+// If coalesce is set, members receiving several events of the same name
+// within CoalescePeriod only deliver the latest one
+func SendUserEvent(name string, payload []byte, coalesce bool) error {
+	if name == "" || len(name) > 0xff {
+		return errors.New("Invalid user event name")
+	}
+	if len(payload) > MaxUserEventSize {
+		return errors.New("User event payload exceeds the size limit")
+	}
+	if !isJoined() {
+		return errNotJoined
+	}
+	event := UserEvent{
+		Name:     name,
+		Payload:  payload,
+		Coalesce: coalesce,
+		LTime:    atomic.AddUint64(&eventClock, 1),
+		From:     LocalIP,
+	}
+	uid := TTLCaches.NewID()
+	self := getCurrentMember()
+	update := Update{uid, TTL_, MemUpdateUserEvent, self.TimeStamp, self.IP, self.State, encodeUserEvent(&event)}
+	TTLCaches.Set(&update)
+	isUpdateDuplicate(uid)
+	UserEventsSent.Inc()
+	deliverUserEvent(event)
+	return nil
+}
+
+// Handle a user event update from another member
+func handleUserEvent(update *Update) {
+	event, err := decodeUserEvent(update.Payload)
+	if err != nil {
+		printError(err)
+		return
+	}
+	event.From = int2ip(update.MemberIP).String()
+	// Witness the clock, so that our next events are ordered after it
+	for {
+		clock := atomic.LoadUint64(&eventClock)
+		if event.LTime <= clock || atomic.CompareAndSwapUint64(&eventClock, clock, event.LTime) {
+			break
+		}
+	}
+	deliverUserEvent(event)
+}
+
+// Publish the event, or hold it back if it may be coalesced
+func deliverUserEvent(event UserEvent) {
+	event.Time = time.Now().UTC()
+	if !event.Coalesce {
+		UserEvents.Publish(event)
+		return
+	}
+	coalesceMutex.Lock()
+	defer coalesceMutex.Unlock()
+	pending, waiting := coalescePending[event.Name]
+	if event.LTime <= coalesceDelivered[event.Name] || (waiting && event.LTime <= pending.LTime) {
+		UserEventsCoalesced.Inc()
+		return
+	}
+	if waiting {
+		UserEventsCoalesced.Inc()
+	}
+	coalescePending[event.Name] = &event
+	if !waiting {
+		afterTimer(CoalescePeriod, func() {
+			coalesceMutex.Lock()
+			latest := coalescePending[event.Name]
+			delete(coalescePending, event.Name)
+			coalesceDelivered[event.Name] = latest.LTime
+			coalesceMutex.Unlock()
+			UserEvents.Publish(*latest)
+			afterTimer(UpdateDeletePeriod, func() {
+				coalesceMutex.Lock()
+				if coalesceDelivered[event.Name] == latest.LTime {
+					delete(coalesceDelivered, event.Name)
+				}
+				coalesceMutex.Unlock()
+			})
+		})
+	}
+}
+
+// Encode as LTime, a coalesce flag, the length prefixed name and payload
+func encodeUserEvent(event *UserEvent) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, event.LTime)
+	if event.Coalesce {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	buf.WriteByte(uint8(len(event.Name)))
+	buf.WriteString(event.Name)
+	binary.Write(&buf, binary.BigEndian, uint16(len(event.Payload)))
+	buf.Write(event.Payload)
+	return buf.Bytes()
+}
+
+func decodeUserEvent(data []byte) (UserEvent, error) {
+	var event UserEvent
+	buf := bytes.NewReader(data)
+	if err := binary.Read(buf, binary.BigEndian, &event.LTime); err != nil {
+		return event, err
+	}
+	flags, err := buf.ReadByte()
+	if err != nil {
+		return event, err
+	}
+	event.Coalesce = flags&1 != 0
+	if event.Name, err = readShortString(buf); err != nil {
+		return event, err
+	}
+	event.Payload, err = readLongBytes(buf)
+	return event, err
+}
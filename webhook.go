@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// An HTTP endpoint the membership events matching its filter are
+// posted to, in batches
+type Webhook struct {
+	Filter EventFilter
+	URL    string
+	queue  chan MemberEvent
+}
+
+// The JSON body posted to a webhook
+type WebhookBatch struct {
+	Node   string        `json:"node"`
+	Events []MemberEvent `json:"events"`
+}
+
+// Parse a webhook spec such as "member-join,member-failed=http://host/hook"
+func ParseWebhook(spec string) (*Webhook, error) {
+	filter, target := splitEventSpec(spec)
+	for _, name := range filter {
+		if strings.HasPrefix(name, "user") {
+			return nil, errors.New("Webhooks only post membership events, invalid filter " + name)
+		}
+	}
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("Invalid webhook URL " + target)
+	}
+	return &Webhook{Filter: filter, URL: target}, nil
+}
+
+// Start the webhooks of Conf.Webhooks. Each has its own bounded queue,
+// so that a slow receiver only drops its own events
+func startWebhooks() {
+	var hooks []*Webhook
+	for _, spec := range Conf.Webhooks {
+		hook, err := ParseWebhook(spec)
+		if err != nil {
+			printError(err)
+			fmt.Println(err)
+			continue
+		}
+		hook.queue = make(chan MemberEvent, Conf.WebhookQueue)
+		hooks = append(hooks, hook)
+		Logger.Info("Webhook", F("filters", strings.Join(hook.Filter, ",")), F("url", hook.URL))
+		goDaemon(hook.run)
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	// Subscribe before the daemon may join
+	sub, _ := Events.Subscribe(WatchBufferSize, nil)
+	goDaemon(func() { dispatchWebhookEvents(hooks, sub) })
+}
+
+// Fan out the membership events to the matching webhooks, without blocking
+func dispatchWebhookEvents(hooks []*Webhook, sub *Subscription) {
+	defer func() { Events.Unsubscribe(sub) }()
+	revision := Events.Revision()
+
+	for {
+		var event MemberEvent
+		var ok bool
+		select {
+		case event, ok = <-sub.C:
+		case <-daemonCtx.Done():
+			return
+		}
+		if !ok {
+			// Fell behind, catch up from the last revision posted
+			var resumed bool
+			sub, resumed = Events.Subscribe(WatchBufferSize, &revision)
+			if !resumed {
+				Logger.Warn("Webhooks missed membership events", F("revision", revision))
+				sub, _ = Events.Subscribe(WatchBufferSize, nil)
+				revision = Events.Revision()
+			}
+			continue
+		}
+		revision = event.Revision
+		for _, hook := range hooks {
+			if !hook.Filter.Match("member-" + event.Type) {
+				continue
+			}
+			select {
+			case hook.queue <- event:
+			default:
+				WebhookEvents.With("dropped").Inc()
+				Logger.Warn("Webhook queue full, event dropped", F("url", hook.URL), F("revision", event.Revision))
+			}
+		}
+	}
+}
+
+// Post the queued events, gathering those arriving within
+// Conf.WebhookBatch of the first one into a single request
+func (h *Webhook) run() {
+	for {
+		var events []MemberEvent
+		select {
+		case event := <-h.queue:
+			events = append(events, event)
+		case <-daemonCtx.Done():
+			return
+		}
+		timer := time.NewTimer(Conf.WebhookBatch)
+		for batching := true; batching && len(events) < MaxWebhookBatch; {
+			select {
+			case event := <-h.queue:
+				events = append(events, event)
+			case <-timer.C:
+				batching = false
+			case <-daemonCtx.Done():
+				timer.Stop()
+				return
+			}
+		}
+		timer.Stop()
+		h.deliver(events)
+	}
+}
+
+// Post the events, retrying with an exponential backoff
+func (h *Webhook) deliver(events []MemberEvent) {
+	body, err := json.Marshal(WebhookBatch{LocalIP, events})
+	if err != nil {
+		printError(err)
+		return
+	}
+	fields := []Field{F("url", h.URL), F("events", len(events))}
+	backoff := WebhookBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := h.post(body)
+		if err == nil {
+			WebhookEvents.With("ok").Add(uint64(len(events)))
+			Logger.Debug("Webhook delivered", fields...)
+			return
+		}
+		if !retry || attempt >= Conf.WebhookRetries {
+			WebhookEvents.With("failed").Add(uint64(len(events)))
+			Logger.Warn("Webhook failed", append(fields, F("attempts", attempt+1), F("err", err))...)
+			return
+		}
+		WebhookRetries.Inc()
+		Logger.Debug("Webhook retry", append(fields, F("backoff", backoff.String()), F("err", err))...)
+		if !sleepDaemon(backoff) {
+			return
+		}
+		if backoff *= 2; backoff > MaxWebhookBackoff {
+			backoff = MaxWebhookBackoff
+		}
+	}
+}
+
+// Post the body once, return whether a failure may be retried
+func (h *Webhook) post(body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(daemonCtx, WebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ssms")
+	if Conf.WebhookSecret != "" {
+		req.Header.Set("X-SSMS-Signature", SignWebhook([]byte(Conf.WebhookSecret), body))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	// Client errors other than throttling will fail again
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, errors.New("Webhook responded " + resp.Status)
+}
+
+// Return the X-SSMS-Signature header of body, its HMAC-SHA256 with secret
+func SignWebhook(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
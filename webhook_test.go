@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A webhook receiver recording the requests, responding with the
+// statuses in turn and then 204
+type hookRecorder struct {
+	mu       sync.Mutex
+	statuses []int
+	bodies   [][]byte
+	headers  []http.Header
+	times    []time.Time
+}
+
+func (rec *hookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.bodies = append(rec.bodies, body)
+	rec.headers = append(rec.headers, r.Header.Clone())
+	rec.times = append(rec.times, time.Now())
+	status := http.StatusNoContent
+	if len(rec.statuses) > 0 {
+		status, rec.statuses = rec.statuses[0], rec.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (rec *hookRecorder) requests() int {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return len(rec.bodies)
+}
+
+// Start a node and a webhook posting to rec, Conf is restored after the test
+func setupWebhook(t *testing.T, rec *hookRecorder) *Webhook {
+	t.Helper()
+	saved := Conf
+	t.Cleanup(func() { Conf = saved })
+	setupNode(t, "10.0.0.1", 1)
+	server := httptest.NewServer(rec)
+	t.Cleanup(server.Close)
+	hook, err := ParseWebhook(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hook
+}
+
+func testEvents(n int) []MemberEvent {
+	events := make([]MemberEvent, n)
+	for i := range events {
+		events[i] = MemberEvent{Revision: uint64(i + 1), Type: EventJoin, Member: MemberInfo{IP: "10.0.0.2"}}
+	}
+	return events
+}
+
+func TestWebhookSignature(t *testing.T) {
+	tests := []struct {
+		secret string
+		signed bool
+	}{
+		{"", false},
+		{"key", true},
+	}
+	for _, tt := range tests {
+		rec := &hookRecorder{}
+		hook := setupWebhook(t, rec)
+		Conf.WebhookSecret = tt.secret
+		hook.deliver(testEvents(2))
+		if rec.requests() != 1 {
+			t.Fatalf("secret %q: %d requests, want 1", tt.secret, rec.requests())
+		}
+		signature := rec.headers[0].Get("X-SSMS-Signature")
+		if !tt.signed {
+			if signature != "" {
+				t.Errorf("unsigned body has signature %q", signature)
+			}
+			continue
+		}
+		mac := hmac.New(sha256.New, []byte(tt.secret))
+		mac.Write(rec.bodies[0])
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); signature != want {
+			t.Errorf("signature %q, want %q", signature, want)
+		}
+	}
+}
+
+func TestWebhookBatch(t *testing.T) {
+	rec := &hookRecorder{}
+	hook := setupWebhook(t, rec)
+	Conf.WebhookBatch = 50 * time.Millisecond
+	hook.queue = make(chan MemberEvent, MaxWebhookBatch+10)
+	for _, event := range testEvents(MaxWebhookBatch + 10) {
+		hook.queue <- event
+	}
+	goDaemon(hook.run)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for rec.requests() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	want := []int{MaxWebhookBatch, 10}
+	if len(rec.bodies) != len(want) {
+		t.Fatalf("%d requests, want %d", len(rec.bodies), len(want))
+	}
+	for i, body := range rec.bodies {
+		var batch WebhookBatch
+		if err := json.Unmarshal(body, &batch); err != nil {
+			t.Fatal(err)
+		}
+		if len(batch.Events) != want[i] || batch.Node != LocalIP {
+			t.Errorf("request %d: %d events from %s, want %d from %s", i, len(batch.Events), batch.Node, want[i], LocalIP)
+		}
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		retries  int
+		want     int
+		result   string
+	}{
+		{"5xx retried with backoff", []int{503, 500}, 5, 3, "ok"},
+		{"429 retried", []int{429}, 5, 2, "ok"},
+		{"4xx not retried", []int{400}, 5, 1, "failed"},
+		{"retries exhausted", []int{503, 503, 503}, 1, 2, "failed"},
+	}
+	for _, tt := range tests {
+		rec := &hookRecorder{statuses: tt.statuses}
+		hook := setupWebhook(t, rec)
+		Conf.WebhookRetries = tt.retries
+		before := WebhookEvents.With(tt.result).Value()
+		hook.deliver(testEvents(1))
+
+		if rec.requests() != tt.want {
+			t.Errorf("%s: %d requests, want %d", tt.name, rec.requests(), tt.want)
+			continue
+		}
+		if got := WebhookEvents.With(tt.result).Value() - before; got != 1 {
+			t.Errorf("%s: %d events counted %s, want 1", tt.name, got, tt.result)
+		}
+		// Each retry waits twice as long as the previous one
+		backoff := WebhookBackoff
+		for i := 1; i < len(rec.times); i++ {
+			if gap := rec.times[i].Sub(rec.times[i-1]); gap < backoff {
+				t.Errorf("%s: retry %d after %s, want at least %s", tt.name, i, gap, backoff)
+			}
+			backoff *= 2
+		}
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	rec := &hookRecorder{}
+	hook := setupWebhook(t, rec)
+	hook.Filter = EventFilter{"member-join"}
+	// Nothing drains the queue, it fills after one event
+	hook.queue = make(chan MemberEvent, 1)
+	sub, _ := Events.Subscribe(WatchBufferSize, nil)
+	goDaemon(func() { dispatchWebhookEvents([]*Webhook{hook}, sub) })
+
+	before := WebhookEvents.With("dropped").Value()
+	for i := 0; i < 3; i++ {
+		Events.Publish(EventJoin, Member{uint64(i + 1), testIP("10.0.0.2"), StateAlive, nil})
+	}
+	// Filtered out, neither queued nor dropped
+	Events.Publish(EventFailed, Member{1, testIP("10.0.0.2"), StateDead, nil})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for WebhookEvents.With("dropped").Value()-before < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := WebhookEvents.With("dropped").Value() - before; got != 2 {
+		t.Errorf("%d events dropped, want 2", got)
+	}
+	if len(hook.queue) != 1 || (<-hook.queue).Member.TimeStamp != 1 {
+		t.Error("queue does not hold the first event")
+	}
+}